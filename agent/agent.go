@@ -1,30 +1,117 @@
 package agent
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
-	"net"
-	"net/http"
+	"os"
 	"sort"
+	"strings"
+	"sync"
 	"time"
+)
 
-	"github.com/fsouza/go-dockerclient"
+const (
+	RuntimeDocker     = "docker"
+	RuntimeSwarm      = "swarm"
+	RuntimeContainerd = "containerd"
+	RuntimeKubernetes = "kubernetes"
+	RuntimeNone       = "none"
 )
 
 type Agent struct {
-	DockerAddress string
-	FusisAddress  string
-	LabelFilter   string
-	Interval      time.Duration
+	Runtime                string
+	Executor               string
+	DockerAddress          string
+	DockerTLSCert          string
+	DockerTLSKey           string
+	DockerTLSCA            string
+	DockerAPIVersion       string
+	SwarmNetwork           string
+	ContainerdAddress      string
+	ContainerdNamespace    string
+	ContainerdPollInterval time.Duration
+	KubernetesAPI          string
+	KubernetesTokenFile    string
+	KubernetesCAFile       string
+	NodeName               string
+	NetNamespace           string
+	Tunnel                 string
+	TunnelName             string
+	TunnelLocal            string
+	TunnelMTU              int
+	Sysctl                 string
+	RulePriority           int
+	TableDropIn            bool
+	FlushConntrack         bool
+	AggregateRules         bool
+	CgroupMatch            bool
+	HealthyOnly            bool
+	WithoutHealthcheck     string
+	BackendsFile           string
+	StateFile              string
+	FusisAddress           string
+	LabelFilter            string
+	Interval               time.Duration
+	VerifyInterval         time.Duration
+
+	// executor runs the commands of the applier and of sources needing them.
+	executor Executor
+	source   ContainerSource
+	applier  Applier
+	// state is the desired state successfully applied by the last reconcile
+	// or restored from StateFile, nil if there's none yet.
+	state *State
+
+	statusMu sync.Mutex
+	status   Status
+
+	// runMu protects the fields of the current, or last, run of the agent.
+	runMu    sync.Mutex
+	cancel   context.CancelFunc
+	stopping bool
+	done     chan struct{}
+	err      error
+}
+
+// ErrStopped is returned by Run and Wait when the agent exits because Stop
+// was called.
+var ErrStopped = errors.New("agent stopped")
 
-	doneCh       chan struct{}
-	quitCh       chan struct{}
-	dockerClient *docker.Client
-	applier      agentApplier
+// Options configures an agent created by New.
+type Options struct {
+	// Router is the fusis router address used by backends, mandatory.
+	Router         string
+	Interval       time.Duration
+	VerifyInterval time.Duration
+	StateFile      string
 }
 
-type agentApplier interface {
-	Apply(ips []string, fusisAddr string) error
+// New returns an agent ready to Run, reconciling the workloads listed by
+// source using applier. Agents created by New must not be initialized by
+// Init, which creates the source and applier from the agent fields.
+func New(source ContainerSource, applier Applier, opts Options) (*Agent, error) {
+	if source == nil {
+		return nil, errors.New("source is mandatory")
+	}
+	if applier == nil {
+		return nil, errors.New("applier is mandatory")
+	}
+	if opts.Router == "" {
+		return nil, errors.New("fusis address is mandatory")
+	}
+	if opts.Interval == 0 {
+		return nil, errors.New("interval is mandatory")
+	}
+	return &Agent{
+		FusisAddress:   opts.Router,
+		Interval:       opts.Interval,
+		VerifyInterval: opts.VerifyInterval,
+		StateFile:      opts.StateFile,
+		source:         source,
+		applier:        applier,
+	}, nil
 }
 
 func (a *Agent) Init() error {
@@ -37,81 +124,429 @@ func (a *Agent) Init() error {
 	if a.Interval == 0 {
 		return errors.New("interval is mandatory")
 	}
-	a.doneCh = make(chan struct{})
-	a.quitCh = make(chan struct{})
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			Dial:                dialer.Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-			MaxIdleConnsPerHost: -1,
-			DisableKeepAlives:   true,
-		},
-		Timeout: time.Minute,
+	switch a.WithoutHealthcheck {
+	case "", HealthcheckInclude, HealthcheckExclude:
+	default:
+		return fmt.Errorf("unknown treatment %q for workloads without healthcheck", a.WithoutHealthcheck)
+	}
+	commands := []string{"ip", "iptables", "iptables-save"}
+	if a.Runtime == RuntimeContainerd || a.NetNamespace != "" {
+		commands = append(commands, "nsenter")
+	}
+	if a.Runtime == RuntimeContainerd {
+		commands = append(commands, "ctr")
+	}
+	if a.Sysctl == SysctlCheck || a.Sysctl == SysctlSet {
+		commands = append(commands, "sysctl")
+	}
+	if a.NetNamespace != "" {
+		if _, err := os.Stat(a.NetNamespace); err != nil {
+			return fmt.Errorf("unable to use network namespace: %s", err)
+		}
 	}
 	var err error
-	a.dockerClient, err = docker.NewClient(a.DockerAddress)
+	a.executor, err = newExecutor(a.Executor, commands)
 	if err != nil {
 		return err
 	}
-	a.dockerClient.Dialer = dialer
-	a.dockerClient.HTTPClient = httpClient
-	a.applier = &natApplier{}
-	return nil
+	a.source, err = a.newSource()
+	if err != nil {
+		return err
+	}
+	a.applier, err = NewNATApplier(NATOptions{
+		Router:         a.FusisAddress,
+		Executor:       a.executor,
+		NetNamespace:   a.NetNamespace,
+		Tunnel:         a.Tunnel,
+		TunnelName:     a.TunnelName,
+		TunnelLocal:    a.TunnelLocal,
+		TunnelMTU:      a.TunnelMTU,
+		Sysctl:         a.Sysctl,
+		RulePriority:   a.RulePriority,
+		TableDropIn:    a.TableDropIn,
+		FlushConntrack: a.FlushConntrack,
+		Aggregate:      a.AggregateRules,
+	})
+	return err
 }
 
+func (a *Agent) newSource() (ContainerSource, error) {
+	var sources multiSource
+	if a.Runtime != RuntimeNone {
+		src, err := a.newRuntimeSource()
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	if a.BackendsFile != "" {
+		sources = append(sources, &fileSource{path: a.BackendsFile})
+	}
+	switch len(sources) {
+	case 0:
+		return nil, errors.New("backends file is mandatory when no container runtime is used")
+	case 1:
+		return sources[0], nil
+	}
+	return sources, nil
+}
+
+func (a *Agent) newRuntimeSource() (ContainerSource, error) {
+	if a.CgroupMatch && a.Runtime != "" && a.Runtime != RuntimeDocker && a.Runtime != RuntimeSwarm {
+		return nil, fmt.Errorf("cgroup matching is not supported by the %s runtime", a.Runtime)
+	}
+	switch a.Runtime {
+	case "", RuntimeDocker:
+		client, err := a.newDockerClient()
+		if err != nil {
+			return nil, err
+		}
+		return &dockerSource{
+			client:           client,
+			labelFilter:      a.LabelFilter,
+			requestedVersion: a.DockerAPIVersion,
+			cgroups:          a.CgroupMatch,
+		}, nil
+	case RuntimeSwarm:
+		if a.SwarmNetwork == "" {
+			return nil, errors.New("swarm network is mandatory")
+		}
+		client, err := a.newDockerClient()
+		if err != nil {
+			return nil, err
+		}
+		return &dockerSource{
+			client:           client,
+			labelFilter:      a.LabelFilter,
+			requestedVersion: a.DockerAPIVersion,
+			network:          a.SwarmNetwork,
+			swarm:            true,
+			cgroups:          a.CgroupMatch,
+		}, nil
+	case RuntimeContainerd:
+		if a.ContainerdAddress == "" {
+			return nil, errors.New("containerd address is mandatory")
+		}
+		if a.ContainerdNamespace == "" {
+			return nil, errors.New("containerd namespace is mandatory")
+		}
+		_, _, err := parseLabelFilter(a.LabelFilter)
+		if err != nil {
+			return nil, err
+		}
+		return &containerdSource{
+			address:     a.ContainerdAddress,
+			namespace:   a.ContainerdNamespace,
+			labelFilter: a.LabelFilter,
+			interval:    a.ContainerdPollInterval,
+			executor:    a.executor,
+		}, nil
+	case RuntimeKubernetes:
+		return newKubernetesSource(a.KubernetesAPI, a.KubernetesTokenFile, a.KubernetesCAFile, a.NodeName, a.LabelFilter)
+	}
+	return nil, fmt.Errorf("unknown container runtime %q", a.Runtime)
+}
+
+// Run runs the agent until ctx is done or Stop is called, returning why it
+// exited: ErrStopped, the ctx error or an error preventing it from running.
+// Commands, requests and the watches in progress are canceled before Run
+// returns.
+func (a *Agent) Run(ctx context.Context) error {
+	runCtx, err := a.begin(ctx)
+	if err != nil {
+		return err
+	}
+	a.spin(runCtx)
+	return a.finish(ctx)
+}
+
+// Start runs the agent in the background, Wait returns when it exits.
 func (a *Agent) Start() {
-	go a.spin()
+	ctx := context.Background()
+	runCtx, err := a.begin(ctx)
+	if err != nil {
+		log.Printf("unable to start agent: %s", err)
+		return
+	}
+	go func() {
+		a.spin(runCtx)
+		a.finish(ctx)
+	}()
 }
 
+// Stop cancels the agent and any command in progress, waiting for it to
+// exit. It may be called multiple times, also when the agent isn't running.
 func (a *Agent) Stop() {
-	a.doneCh <- struct{}{}
+	a.runMu.Lock()
+	cancel, done := a.cancel, a.done
+	if cancel != nil {
+		a.stopping = true
+	}
+	a.runMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Wait blocks until the agent exits, returning why it did as in Run. It
+// returns nil if the agent was never started.
+func (a *Agent) Wait() error {
+	a.runMu.Lock()
+	done := a.done
+	a.runMu.Unlock()
+	if done == nil {
+		return nil
+	}
+	<-done
+	a.runMu.Lock()
+	defer a.runMu.Unlock()
+	return a.err
 }
 
-func (a *Agent) Wait() {
-	<-a.quitCh
-	a.quitCh = make(chan struct{})
+// begin marks the agent as running with a clean status, returning the
+// context canceled by Stop.
+func (a *Agent) begin(ctx context.Context) (context.Context, error) {
+	if a.source == nil || a.applier == nil {
+		return nil, errors.New("agent not initialized")
+	}
+	a.runMu.Lock()
+	defer a.runMu.Unlock()
+	if a.cancel != nil {
+		return nil, errors.New("agent already running")
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	a.cancel = cancel
+	a.stopping = false
+	a.done = make(chan struct{})
+	a.err = nil
+	a.statusMu.Lock()
+	a.status = Status{}
+	a.statusMu.Unlock()
+	return runCtx, nil
 }
 
-func (a *Agent) spin() {
-	defer close(a.quitCh)
+// finish marks the agent as stopped, ctx is the context given to the run.
+func (a *Agent) finish(ctx context.Context) error {
+	a.runMu.Lock()
+	defer a.runMu.Unlock()
+	a.cancel()
+	a.cancel = nil
+	a.err = ctx.Err()
+	if a.stopping || a.err == nil {
+		a.err = ErrStopped
+	}
+	close(a.done)
+	return a.err
+}
+
+// spin reconciles until ctx is done, which is the only way it returns.
+func (a *Agent) spin(ctx context.Context) {
+	changes := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.watch(changes, ctx.Done())
+	}()
+	if watcher, ok := a.applier.(DriftWatcher); ok {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.watchDrift(watcher, changes, ctx.Done())
+		}()
+	}
+	a.restoreState(ctx)
+	var verify <-chan time.Time
+	if a.VerifyInterval > 0 {
+		ticker := time.NewTicker(a.VerifyInterval)
+		defer ticker.Stop()
+		verify = ticker.C
+	}
 	for {
-		opts := docker.ListContainersOptions{
-			Filters: map[string][]string{"label": {a.LabelFilter}},
+		next := a.Interval
+		if err := a.reconcile(ctx); ctx.Err() == nil {
+			next = a.recordReconcile(err)
 		}
-		conts, err := a.dockerClient.ListContainers(opts)
-		if err != nil {
-			log.Printf("error listing containers: %s", err.Error())
-		}
-		var ips []string
-		for _, c := range conts {
-			var ip string
-			bridge, ok := c.Networks.Networks["bridge"]
-			if ok {
-				ip = bridge.IPAddress
-			} else {
-				var cont *docker.Container
-				cont, err = a.dockerClient.InspectContainer(c.ID)
-				if err != nil {
-					log.Printf("error inspecting container: %s", err.Error())
-					continue
-				}
-				ip = cont.NetworkSettings.IPAddress
+		// Stopping takes precedence over pending changes.
+		if ctx.Err() != nil {
+			return
+		}
+		if !a.wait(ctx, next, changes, verify) {
+			return
+		}
+	}
+}
+
+// wait blocks until the next reconcile is due, either by a change, drift
+// found when verifying the applied rules or after delay. It returns false
+// when the agent is stopped.
+func (a *Agent) wait(ctx context.Context, delay time.Duration, changes <-chan struct{}, verify <-chan time.Time) bool {
+	timeout := time.After(delay)
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changes:
+			return true
+		case <-timeout:
+			return true
+		case <-verify:
+			if a.state == nil {
+				continue
+			}
+			drift, err := a.applier.Verify(ctx, a.state.Backends)
+			if err != nil {
+				log.Printf("error verifying rules using %T: %s", a.applier, err)
+				continue
+			}
+			if len(drift) > 0 {
+				a.drifted(strings.Join(drift, ", "))
+				return true
 			}
-			ips = append(ips, ip)
 		}
-		sort.Strings(ips)
-		err = a.applier.Apply(ips, a.FusisAddress)
+	}
+}
+
+// watch keeps the source watch running until stop is closed, restarting it
+// after Interval in case of errors. Polling is still done in spin as a
+// failsafe for missed changes.
+func (a *Agent) watch(changes chan<- struct{}, stop <-chan struct{}) {
+	for {
+		err := a.source.Watch(changes, stop)
 		if err != nil {
-			log.Printf("error applying rules using %T: %s", a.applier, err)
+			log.Printf("error watching changes using %T: %s", a.source, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(a.Interval):
+		}
+	}
+}
+
+// watchDrift triggers a reconcile whenever the applier notices its
+// configuration was changed by someone else, until stop is closed.
+func (a *Agent) watchDrift(watcher DriftWatcher, changes chan<- struct{}, stop <-chan struct{}) {
+	for {
+		err := watcher.WatchDrift(stop, func(reason string) {
+			a.drifted(reason)
+			notifyChange(changes)
+		})
+		if err != nil {
+			log.Printf("error watching changes using %T: %s", watcher, err)
 		}
 		select {
-		case <-a.doneCh:
+		case <-stop:
 			return
 		case <-time.After(a.Interval):
 		}
 	}
 }
+
+func (a *Agent) drifted(reason string) {
+	log.Printf("drift detected: %s", reason)
+	metrics.Add("drifts", 1)
+}
+
+func (a *Agent) reconcile(ctx context.Context) error {
+	workloads, err := a.source.List(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("error listing workloads using %T: %s", a.source, err)
+		}
+		return fmt.Errorf("error listing workloads: %s", err)
+	}
+	workloads, excluded := a.filterHealthy(workloads)
+	a.setStatusExcluded(excluded)
+	state := a.desiredState(workloads)
+	err = a.applier.Apply(ctx, state.Backends)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("error applying rules using %T: %s", a.applier, err)
+		}
+		return fmt.Errorf("error applying rules: %s", err)
+	}
+	if reporter, ok := a.applier.(ProblemReporter); ok {
+		a.setStatusProblems(reporter.Problems())
+	}
+	a.saveState(state)
+	return nil
+}
+
+func (a *Agent) desiredState(workloads []Workload) *State {
+	state := &State{
+		Router:   a.FusisAddress,
+		Backends: []Backend{},
+	}
+	if nat, ok := a.applier.(*NATApplier); ok {
+		nat.describe(state)
+	}
+	// Sources may overlap, each address, port or cgroup is only used once.
+	targets := make(map[string]struct{})
+	for _, w := range workloads {
+		var backends []Backend
+		for _, ip := range w.IPs {
+			backends = append(backends, Backend{IP: ip})
+		}
+		if w.Cgroup != "" {
+			backends = append(backends, Backend{Cgroup: w.Cgroup, Pid: w.Pid})
+		} else {
+			for _, port := range w.HostPorts {
+				backends = append(backends, Backend{Port: port})
+			}
+		}
+		for _, b := range backends {
+			if _, isDup := targets[b.target()]; isDup {
+				continue
+			}
+			targets[b.target()] = struct{}{}
+			b.ContainerID = w.ID
+			b.Name = w.Name
+			b.Labels = w.Labels
+			b.Network = w.Network
+			b.Router = a.FusisAddress
+			state.Backends = append(state.Backends, b)
+		}
+	}
+	sort.Sort(backendsByIP(state.Backends))
+	return state
+}
+
+// saveState keeps state as the applied state, persisting it if it changed.
+func (a *Agent) saveState(state *State) {
+	previous := a.state
+	a.state = state
+	a.setStatusBackends(state.Backends)
+	if a.StateFile == "" || state.sameAs(previous) {
+		return
+	}
+	state.UpdatedAt = time.Now().UTC()
+	err := writeState(a.StateFile, state)
+	if err != nil {
+		log.Printf("error writing state file: %s", err)
+	}
+}
+
+// restoreState loads the state persisted by a previous run, removing
+// anything created by a different configuration. Until the first successful
+// reconcile the restored state is used to verify the applied rules.
+func (a *Agent) restoreState(ctx context.Context) {
+	if a.StateFile == "" {
+		return
+	}
+	state, err := ReadState(a.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error reading state file: %s", err)
+		}
+		return
+	}
+	err = a.applier.Cleanup(ctx, state)
+	if err != nil {
+		log.Printf("error cleaning up previous state using %T: %s", a.applier, err)
+	}
+	a.state = state
+}
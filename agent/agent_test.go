@@ -1,6 +1,9 @@
 package agent
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
@@ -10,9 +13,10 @@ import (
 
 func (s *S) TestAgentInit(c *check.C) {
 	a := Agent{
-		FusisAddress: "10.0.0.1",
-		LabelFilter:  "router=fusis",
-		Interval:     time.Second,
+		DockerAddress: "ftp://localhost",
+		FusisAddress:  "10.0.0.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Second,
 	}
 	err := a.Init()
 	c.Assert(err, check.ErrorMatches, "invalid endpoint")
@@ -60,8 +64,9 @@ func (s *S) TestAgentStart(c *check.C) {
 	err = a.Init()
 	c.Assert(err, check.IsNil)
 	a.Start()
+	waitReconcile(c, &a)
 	a.Stop()
-	a.Wait()
+	c.Assert(a.Wait(), check.Equals, ErrStopped)
 	c.Assert(s.executor.log, check.DeepEquals, baseExpected)
 	cli, err := docker.NewClient(srv.URL())
 	c.Assert(err, check.IsNil)
@@ -77,11 +82,211 @@ func (s *S) TestAgentStart(c *check.C) {
 	c.Assert(err, check.IsNil)
 	err = cli.StartContainer(cont.ID, nil)
 	c.Assert(err, check.IsNil)
+	cont, err = cli.InspectContainer(cont.ID)
+	c.Assert(err, check.IsNil)
 	s.executor.log = nil
 	a.Start()
+	waitReconcile(c, &a)
 	a.Stop()
-	a.Wait()
+	c.Assert(a.Wait(), check.Equals, ErrStopped)
 	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "172.16.42.53", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", cont.NetworkSettings.IPAddress, "-m", "comment", "--comment", cont.ID, "-j", "MARK", "--set-mark", "9"},
 	}...))
 }
+
+// waitReconcile waits until the running agent finishes a reconcile.
+func waitReconcile(c *check.C, a *Agent) {
+	timeout := time.After(5 * time.Second)
+	for a.Status().LastReconcile == nil {
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for reconcile")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *S) TestAgentRun(c *check.C) {
+	newAgent := func() *Agent {
+		return &Agent{
+			FusisAddress: "192.168.1.1",
+			Interval:     time.Minute,
+			source:       &fakeSource{watching: make(chan struct{}, 1)},
+			applier:      newTestNAT(c),
+		}
+	}
+	a := newAgent()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- a.Run(ctx)
+	}()
+	waitReconcile(c, a)
+	c.Assert(a.Run(context.Background()), check.ErrorMatches, "agent already running")
+	cancel()
+	select {
+	case err := <-errCh:
+		c.Assert(err, check.Equals, context.Canceled)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for agent to exit")
+	}
+	c.Assert(a.Wait(), check.Equals, context.Canceled)
+	a.Stop()
+	a = newAgent()
+	go func() {
+		errCh <- a.Run(context.Background())
+	}()
+	waitReconcile(c, a)
+	a.Stop()
+	a.Stop()
+	c.Assert(<-errCh, check.Equals, ErrStopped)
+	c.Assert(a.Wait(), check.Equals, ErrStopped)
+}
+
+func (s *S) TestAgentRunNotInitialized(c *check.C) {
+	a := Agent{}
+	a.Stop()
+	c.Assert(a.Wait(), check.IsNil)
+	c.Assert(a.Run(context.Background()), check.ErrorMatches, "agent not initialized")
+}
+
+type blockingExecutor struct {
+	called chan struct{}
+}
+
+func (e *blockingExecutor) Exec(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	e.called <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *S) TestAgentStopCancelsCommands(c *check.C) {
+	exec := &blockingExecutor{called: make(chan struct{}, 1)}
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Executor: exec})
+	c.Assert(err, check.IsNil)
+	a := Agent{
+		FusisAddress: "192.168.1.1",
+		LabelFilter:  "router=fusis",
+		Interval:     time.Minute,
+		source:       &fakeSource{workloads: []Workload{{ID: "c1", IPs: []string{"10.0.0.1"}}}},
+		applier:      nat,
+	}
+	a.Start()
+	select {
+	case <-exec.called:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for command")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		a.Stop()
+		c.Check(a.Wait(), check.Equals, ErrStopped)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for agent to stop")
+	}
+}
+
+func (s *S) TestAgentInitExecutor(c *check.C) {
+	var mode string
+	var commands []string
+	newExecutor = func(m string, cmds []string) (Executor, error) {
+		mode, commands = m, cmds
+		return nil, errors.New("missing capabilities")
+	}
+	a := Agent{
+		Runtime:             RuntimeContainerd,
+		Executor:            ExecutorDirect,
+		ContainerdAddress:   "/run/containerd/containerd.sock",
+		ContainerdNamespace: "default",
+		FusisAddress:        "10.0.0.1",
+		LabelFilter:         "router=fusis",
+		Interval:            time.Second,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, "missing capabilities")
+	c.Assert(mode, check.Equals, ExecutorDirect)
+	c.Assert(commands, check.DeepEquals, []string{"ip", "iptables", "iptables-save", "nsenter", "ctr"})
+}
+
+func (s *S) TestAgentInitNetNamespace(c *check.C) {
+	a := Agent{
+		Runtime:      RuntimeNone,
+		BackendsFile: "/etc/fusis/backends",
+		NetNamespace: "/var/run/netns/fusis-nonexistent",
+		FusisAddress: "192.168.1.1",
+		LabelFilter:  "router=fusis",
+		Interval:     time.Second,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, "unable to use network namespace: .*no such file or directory")
+	a.NetNamespace = s.tempfile
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	c.Assert(a.executor, check.Equals, s.executor)
+	err = a.applier.Apply(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log[0], check.DeepEquals, []string{"nsenter", "--net=" + s.tempfile, "--", "ip", "route", "add", "default", "via", "192.168.1.1", "table", "100"})
+}
+
+func metricValue(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func (s *S) TestAgentWaitVerify(c *check.C) {
+	a := Agent{
+		Interval: time.Minute,
+		applier:  newTestNAT(c),
+		state:    &State{Backends: []Backend{{IP: "10.0.0.1"}}},
+	}
+	drifts := metricValue("drifts")
+	verify := make(chan time.Time, 1)
+	verify <- time.Now()
+	c.Assert(a.wait(context.Background(), time.Minute, nil, verify), check.Equals, true)
+	c.Assert(s.executor.log, check.DeepEquals, [][]string{{"iptables-save", "-t", "mangle"}})
+	c.Assert(metricValue("drifts"), check.Equals, drifts+1)
+}
+
+func (s *S) TestNewAgent(c *check.C) {
+	source := &fakeSource{workloads: []Workload{{ID: "c1", Name: "web", IPs: []string{"10.0.0.1"}}}}
+	applier := &fakeApplier{}
+	_, err := New(nil, applier, Options{Router: "192.168.1.1", Interval: time.Minute})
+	c.Assert(err, check.ErrorMatches, "source is mandatory")
+	_, err = New(source, nil, Options{Router: "192.168.1.1", Interval: time.Minute})
+	c.Assert(err, check.ErrorMatches, "applier is mandatory")
+	_, err = New(source, applier, Options{Interval: time.Minute})
+	c.Assert(err, check.ErrorMatches, "fusis address is mandatory")
+	_, err = New(source, applier, Options{Router: "192.168.1.1"})
+	c.Assert(err, check.ErrorMatches, "interval is mandatory")
+	a, err := New(source, applier, Options{Router: "192.168.1.1", Interval: time.Minute})
+	c.Assert(err, check.IsNil)
+	err = a.reconcile(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(applier.applied, check.DeepEquals, []Backend{{IP: "10.0.0.1", ContainerID: "c1", Name: "web", Router: "192.168.1.1"}})
+	c.Assert(a.Status().Backends, check.DeepEquals, applier.applied)
+	c.Assert(a.state.Chain, check.Equals, "")
+	c.Assert(s.executor.log, check.IsNil)
+}
+
+type fakeApplier struct {
+	applied []Backend
+}
+
+func (a *fakeApplier) Apply(ctx context.Context, backends []Backend) error {
+	a.applied = backends
+	return nil
+}
+
+func (a *fakeApplier) Verify(ctx context.Context, backends []Backend) ([]string, error) {
+	return nil, nil
+}
+
+func (a *fakeApplier) Cleanup(ctx context.Context, old *State) error {
+	return nil
+}
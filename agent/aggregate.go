@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// maxExpandedPrefix is the shortest prefix length expanded into its
+// addresses. Aggregated prefixes only cover backends, so it's never reached
+// in practice, but rules added by others may use any prefix.
+const maxExpandedPrefix = 16
+
+// aggregateBackends collapses the addresses of backends into the minimal set
+// of prefixes covering exactly them. Backends alone in their prefix are kept
+// as they are, prefixes covering many have no workload details. Backends
+// without an IPv4 address are kept unchanged.
+func aggregateBackends(backends []Backend) []Backend {
+	byAddr := make(map[uint32]Backend)
+	var addrs []uint32
+	var result []Backend
+	for _, b := range backends {
+		ip := net.ParseIP(b.IP).To4()
+		if ip == nil {
+			result = append(result, b)
+			continue
+		}
+		addr := binary.BigEndian.Uint32(ip)
+		if _, isDup := byAddr[addr]; !isDup {
+			byAddr[addr] = b
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Sort(uint32Slice(addrs))
+	for i := 0; i < len(addrs); {
+		run := 1
+		for i+run < len(addrs) && addrs[i+run] == addrs[i]+uint32(run) {
+			run++
+		}
+		// The shortest prefix aligned at the first address and within the
+		// contiguous run.
+		prefix := 32
+		for prefix > 0 {
+			next := uint64(1) << uint(33-prefix)
+			if uint64(addrs[i])%next != 0 || next > uint64(run) {
+				break
+			}
+			prefix--
+		}
+		size := int(uint64(1) << uint(32-prefix))
+		if size == 1 {
+			result = append(result, byAddr[addrs[i]])
+		} else {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, addrs[i])
+			result = append(result, Backend{IP: fmt.Sprintf("%s/%d", ip, prefix), Router: byAddr[addrs[i]].Router})
+		}
+		i += size
+	}
+	return result
+}
+
+type uint32Slice []uint32
+
+func (l uint32Slice) Len() int           { return len(l) }
+func (l uint32Slice) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l uint32Slice) Less(i, j int) bool { return l[i] < l[j] }
+
+// expandPrefix returns the addresses in the prefix, as in "10.0.0.0/30", or
+// the address itself if it's not a prefix. It returns false for invalid or
+// IPv6 prefixes and for ones shorter than maxExpandedPrefix.
+func expandPrefix(cidr string) ([]string, bool) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		return []string{ip.String()}, true
+	}
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return nil, false
+	}
+	ones, _ := ipNet.Mask.Size()
+	if ones < maxExpandedPrefix {
+		return nil, false
+	}
+	first := binary.BigEndian.Uint32(ipNet.IP.To4())
+	addrs := make([]string, 0, 1<<uint(32-ones))
+	for i := uint32(0); i < 1<<uint(32-ones); i++ {
+		addr := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(addr, first+i)
+		addrs = append(addrs, addr.String())
+	}
+	return addrs, true
+}
+
+// unusedAddrs returns the addresses in the removed prefixes which are not
+// used by backends anymore, as a prefix may be removed because backends
+// were aggregated differently.
+func unusedAddrs(removed []string, backends []Backend) []string {
+	used := make(map[string]bool)
+	for _, b := range backends {
+		used[b.IP] = true
+	}
+	var unused []string
+	for _, prefix := range removed {
+		addrs, _ := expandPrefix(prefix)
+		for _, addr := range addrs {
+			if !used[addr] {
+				unused = append(unused, addr)
+			}
+		}
+	}
+	return unused
+}
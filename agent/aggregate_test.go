@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"context"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestAggregateBackends(c *check.C) {
+	backends := []Backend{
+		{IP: "10.0.0.4", ContainerID: "c4"},
+		{IP: "10.0.0.1", ContainerID: "c1"},
+		{IP: "10.0.0.2", ContainerID: "c2"},
+		{IP: "10.0.0.3", ContainerID: "c3"},
+		{IP: "10.0.0.3", ContainerID: "c3"},
+		{IP: "10.0.1.0"},
+		{IP: "10.0.1.1"},
+		{IP: "10.0.1.2"},
+		{IP: "10.0.1.3"},
+		{IP: "10.0.1.5"},
+		{Port: "80/tcp"},
+	}
+	c.Assert(aggregateBackends(backends), check.DeepEquals, []Backend{
+		{Port: "80/tcp"},
+		{IP: "10.0.0.1", ContainerID: "c1"},
+		{IP: "10.0.0.2/31"},
+		{IP: "10.0.0.4", ContainerID: "c4"},
+		{IP: "10.0.1.0/30"},
+		{IP: "10.0.1.5"},
+	})
+	c.Assert(aggregateBackends(nil), check.IsNil)
+}
+
+func (s *S) TestExpandPrefix(c *check.C) {
+	addrs, ok := expandPrefix("10.0.0.2/31")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(addrs, check.DeepEquals, []string{"10.0.0.2", "10.0.0.3"})
+	addrs, ok = expandPrefix("10.0.0.1")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(addrs, check.DeepEquals, []string{"10.0.0.1"})
+	_, ok = expandPrefix("10.0.0.0/8")
+	c.Assert(ok, check.Equals, false)
+	_, ok = expandPrefix("port 80/tcp")
+	c.Assert(ok, check.Equals, false)
+	c.Assert(unusedAddrs([]string{"10.0.0.0/30", "10.0.0.5"}, testBackends("10.0.0.0", "10.0.0.1")), check.DeepEquals,
+		[]string{"10.0.0.2", "10.0.0.3", "10.0.0.5"})
+}
+
+func (s *S) TestApplyAggregate(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Aggregate: true, FlushConntrack: true})
+	c.Assert(err, check.IsNil)
+	var flushed []string
+	defer func(orig func(context.Context, string, []string) (int, error)) { conntrackFlush = orig }(conntrackFlush)
+	conntrackFlush = func(ctx context.Context, netns string, ips []string) (int, error) {
+		flushed = append(flushed, ips...)
+		return len(ips), nil
+	}
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.2/31", "-j", "MARK", "--set-mark", "9"},
+	}...))
+	s.executor.log = nil
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:FUSIS - [0:0]
+-A PREROUTING -j FUSIS
+-A FUSIS -s 10.0.0.1/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.2/31 -j MARK --set-xmark 0x9/0xffffffff
+COMMIT
+`)},
+	}
+	drift, err := nat.Verify(context.Background(), testBackends("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.IsNil)
+	tables := ipTables{Table: "mangle"}
+	ips, err := tables.ListSource(context.Background(), DefaultChain)
+	c.Assert(err, check.IsNil)
+	c.Assert(ips, check.DeepEquals, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	// Only the address no longer used is flushed when prefixes change.
+	s.executor.log = nil
+	err = nat.Apply(context.Background(), testBackends("10.0.0.0", "10.0.0.1", "10.0.0.2"))
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log[len(s.executor.log)-4:], check.DeepEquals, [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.0/31", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.1/32", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.2/31", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+	})
+	c.Assert(flushed, check.DeepEquals, []string{"10.0.0.3"})
+}
+
+func (s *S) TestApplyRemovesAggregatedRules(c *check.C) {
+	nat := newTestNAT(c)
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:FUSIS - [0:0]
+-A PREROUTING -j FUSIS
+-A FUSIS -s 10.0.0.2/31 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.3/31 -j MARK --set-xmark 0x9/0xffffffff
+COMMIT
+`)},
+	}
+	drift, err := nat.Verify(context.Background(), testBackends("10.0.0.2", "10.0.0.3"))
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{
+		"missing rule for 10.0.0.2",
+		"missing rule for 10.0.0.3",
+		"stale rule -s 10.0.0.2/31 -j MARK --set-xmark 0x9/0xffffffff",
+		"unexpected rule -s 10.0.0.3/31 -j MARK --set-xmark 0x9/0xffffffff",
+	})
+}
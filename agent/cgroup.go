@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procDir is where processes are looked up to resolve their cgroup, the
+// agent must share the PID namespace of the host.
+var procDir = "/proc"
+
+// processCgroup returns the cgroup v2 path of the process, as matched by the
+// iptables cgroup match.
+func processCgroup(pid int) (string, error) {
+	if pid == 0 {
+		return "", fmt.Errorf("container is not running")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The unified hierarchy is the one with ID 0 and no controllers.
+		if strings.HasPrefix(line, "0::") {
+			path := strings.TrimPrefix(line, "0::")
+			if path == "/" || strings.HasSuffix(path, " (deleted)") {
+				break
+			}
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 path for process %d", pid)
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	dockerTesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) writeProcCgroup(c *check.C, pid, data string) {
+	err := os.MkdirAll(filepath.Join(s.tempdir, "proc", pid), 0755)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(s.tempdir, "proc", pid, "cgroup"), []byte(data), 0644)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestProcessCgroup(c *check.C) {
+	defer func(orig string) { procDir = orig }(procDir)
+	procDir = filepath.Join(s.tempdir, "proc")
+	s.writeProcCgroup(c, "10", "0::/system.slice/docker-c1.scope\n")
+	s.writeProcCgroup(c, "11", "12:cpuset:/docker/c2\n1:name=systemd:/docker/c2\n")
+	s.writeProcCgroup(c, "12", "1:name=systemd:/docker/c3\n0::/\n")
+	path, err := processCgroup(10)
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Equals, "/system.slice/docker-c1.scope")
+	_, err = processCgroup(11)
+	c.Assert(err, check.ErrorMatches, `no cgroup v2 path for process 11`)
+	_, err = processCgroup(12)
+	c.Assert(err, check.ErrorMatches, `no cgroup v2 path for process 12`)
+	_, err = processCgroup(13)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = processCgroup(0)
+	c.Assert(err, check.ErrorMatches, `container is not running`)
+}
+
+func (s *S) TestDockerSourceListCgroup(c *check.C) {
+	defer func(orig string) { procDir = orig }(procDir)
+	procDir = filepath.Join(s.tempdir, "proc")
+	s.writeProcCgroup(c, "10", "0::/system.slice/docker-c1.scope\n")
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	srv.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+  {"Id": "c1", "Names": ["/c1"], "Labels": {"fusis.ports": "8080"}, "NetworkSettings": {"Networks": {"host": {}}}},
+  {"Id": "c2", "Names": ["/c2"], "Labels": {"fusis.ports": "9090"}, "NetworkSettings": {"Networks": {"host": {}}}},
+  {"Id": "c3", "Names": ["/c3"], "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}}
+]`))
+	}))
+	srv.CustomHandler("/containers/c1/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id": "c1", "State": {"Running": true, "Pid": 10}, "NetworkSettings": {}}`))
+	}))
+	srv.CustomHandler("/containers/c2/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id": "c2", "State": {"Running": true, "Pid": 11}, "NetworkSettings": {}}`))
+	}))
+	a := Agent{
+		DockerAddress: srv.URL(),
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+		CgroupMatch:   true,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	workloads, err := a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	labels := map[string]string{"fusis.ports": "8080"}
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{ID: "c1", Name: "c1", Labels: labels, Network: "host", HostPorts: []string{"8080/tcp"}, Cgroup: "/system.slice/docker-c1.scope", Pid: 10},
+		{ID: "c2", Name: "c2", Labels: map[string]string{"fusis.ports": "9090"}, Network: "host", HostPorts: []string{"9090/tcp"}},
+		{ID: "c3", Name: "c3", IPs: []string{"172.17.0.2"}, Network: "bridge"},
+	})
+	// Bridged containers are reported as still marked by address.
+	c.Assert(a.source.(*dockerSource).cgroupWarned, check.DeepEquals, map[string]struct{}{"c3": {}})
+	state := a.desiredState(workloads)
+	c.Assert(state.Backends, check.DeepEquals, []Backend{
+		{Cgroup: "/system.slice/docker-c1.scope", Pid: 10, ContainerID: "c1", Name: "c1", Labels: labels, Network: "host", Router: "192.168.1.1"},
+		{Port: "9090/tcp", ContainerID: "c2", Name: "c2", Labels: map[string]string{"fusis.ports": "9090"}, Network: "host", Router: "192.168.1.1"},
+		{IP: "172.17.0.2", ContainerID: "c3", Name: "c3", Network: "bridge", Router: "192.168.1.1"},
+	})
+}
+
+func (s *S) TestAgentInitCgroupMatchRuntime(c *check.C) {
+	a := Agent{
+		Runtime:           RuntimeContainerd,
+		ContainerdAddress: "/run/containerd/containerd.sock",
+		FusisAddress:      "192.168.1.1",
+		LabelFilter:       "router=fusis",
+		Interval:          time.Minute,
+		CgroupMatch:       true,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, `cgroup matching is not supported by the containerd runtime`)
+}
+
+func (s *S) TestApplyCgroup(c *check.C) {
+	nat := newTestNAT(c)
+	backends := []Backend{{Cgroup: "/system.slice/docker-c1.scope", Pid: 10, ContainerID: "c1"}}
+	err := nat.Apply(context.Background(), backends)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-N", "FUSIS_OUTPUT"},
+		{"iptables", "-t", "mangle", "-w", "5", "-I", "OUTPUT", "-j", "FUSIS_OUTPUT"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS_OUTPUT", "-m", "cgroup", "--path", "/system.slice/docker-c1.scope", "-m", "comment", "--comment", "c1 pid 10", "-j", "MARK", "--set-mark", "9"},
+	}...))
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:FUSIS - [0:0]
+:FUSIS_OUTPUT - [0:0]
+-A PREROUTING -j FUSIS
+-A OUTPUT -j FUSIS_OUTPUT
+-A FUSIS_OUTPUT -m cgroup --path /system.slice/docker-c1.scope -m comment --comment "c1 pid 10" -j MARK --set-xmark 0x9/0xffffffff
+COMMIT
+`)},
+	}
+	drift, err := nat.Verify(context.Background(), backends)
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.IsNil)
+	// The container restarted in a new cgroup with the same path.
+	backends[0].Pid = 20
+	drift, err = nat.Verify(context.Background(), backends)
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{
+		`missing rule for cgroup /system.slice/docker-c1.scope (container c1)`,
+		`outdated rule -m cgroup --path /system.slice/docker-c1.scope -m comment --comment "c1 pid 10" -j MARK --set-xmark 0x9/0xffffffff`,
+	})
+}
@@ -0,0 +1,247 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	nfnlSubsysCtnetlink = 1
+	ipctnlMsgCtGet      = 1
+	ipctnlMsgCtDelete   = 2
+	// sizeofNfgenmsg is the size of the header following the netlink one in
+	// netfilter messages, with the address family.
+	sizeofNfgenmsg = 4
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaZone       = 18
+	ctaTupleIP    = 1
+	ctaIPv4Src    = 1
+	// nlaTypeMask clears the nested and byte order flags from attribute
+	// types.
+	nlaTypeMask = 0x3fff
+)
+
+// flushConntrack deletes the conntrack entries of connections whose packets
+// have one of ips as source, in either direction, in the network namespace
+// at netns, or in the current one if netns is empty. It returns the number
+// of entries deleted.
+func flushConntrack(ctx context.Context, netns string, ips []string) (int, error) {
+	wanted := make(map[[4]byte]bool)
+	for _, ipStr := range ips {
+		if ip := net.ParseIP(ipStr).To4(); ip != nil {
+			var addr [4]byte
+			copy(addr[:], ip)
+			wanted[addr] = true
+		}
+	}
+	if len(wanted) == 0 {
+		return 0, nil
+	}
+	fd, err := netlinkSocket(netns, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return 0, err
+	}
+	file, err := newPollFile(fd)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return flushConntrackEntries(ctx, &netfilterConn{file: file}, wanted)
+}
+
+// flushConntrackEntries dumps the conntrack entries through conn, deleting
+// the ones with a wanted source. The connection is closed if ctx is done,
+// interrupting a pending request.
+func flushConntrackEntries(ctx context.Context, conn *netfilterConn, wanted map[[4]byte]bool) (int, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.file.Close()
+		case <-done:
+		}
+	}()
+	var deletions [][]byte
+	err := conn.request(ipctnlMsgCtGet, syscall.NLM_F_DUMP, nil, func(msg *syscall.NetlinkMessage) {
+		if attrs, ok := conntrackDeletion(msg.Data, wanted); ok {
+			deletions = append(deletions, attrs)
+		}
+	})
+	if err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	var deleted int
+	for _, attrs := range deletions {
+		err = conn.request(ipctnlMsgCtDelete, syscall.NLM_F_ACK, attrs, nil)
+		if err == syscall.ENOENT {
+			// The connection was closed meanwhile.
+			continue
+		}
+		if err != nil {
+			return deleted, ctxErr(ctx, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// ctxErr returns the context error if it's done, the cause of reads failing
+// after the socket is closed.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// netfilterConn sends ctnetlink requests through a netlink socket.
+type netfilterConn struct {
+	file *pollFile
+	seq  uint32
+	buf  []byte
+}
+
+// request sends a message of the given type with attrs, calling fn with
+// each reply until the request is done.
+func (c *netfilterConn) request(msgType, flags uint16, attrs []byte, fn func(*syscall.NetlinkMessage)) error {
+	c.seq++
+	length := syscall.NLMSG_HDRLEN + sizeofNfgenmsg + len(attrs)
+	req := make([]byte, length)
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&req[0])) = syscall.NlMsghdr{
+		Len:   uint32(length),
+		Type:  nfnlSubsysCtnetlink<<8 | msgType,
+		Flags: syscall.NLM_F_REQUEST | flags,
+		Seq:   c.seq,
+	}
+	req[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	copy(req[syscall.NLMSG_HDRLEN+sizeofNfgenmsg:], attrs)
+	_, err := c.file.Write(req)
+	if err != nil {
+		return err
+	}
+	if c.buf == nil {
+		c.buf = make([]byte, 64*1024)
+	}
+	for {
+		n, err := c.file.Read(c.buf)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(c.buf[:n])
+		if err != nil {
+			return err
+		}
+		for i := range msgs {
+			msg := &msgs[i]
+			if msg.Header.Seq != c.seq {
+				continue
+			}
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return syscall.EINVAL
+				}
+				if errno := -*(*int32)(unsafe.Pointer(&msg.Data[0])); errno != 0 {
+					return syscall.Errno(errno)
+				}
+				// An acknowledgment.
+				return nil
+			}
+			if fn != nil {
+				fn(msg)
+			}
+			if msg.Header.Flags&syscall.NLM_F_MULTI == 0 && flags&syscall.NLM_F_ACK == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// netlinkAttr is a netlink attribute, with its type without flags.
+type netlinkAttr struct {
+	Type  uint16
+	Value []byte
+	Raw   []byte
+}
+
+func parseNetlinkAttrs(data []byte) []netlinkAttr {
+	var attrs []netlinkAttr
+	for len(data) >= syscall.SizeofRtAttr {
+		attr := (*syscall.RtAttr)(unsafe.Pointer(&data[0]))
+		if int(attr.Len) < syscall.SizeofRtAttr || int(attr.Len) > len(data) {
+			break
+		}
+		attrs = append(attrs, netlinkAttr{
+			Type:  attr.Type & nlaTypeMask,
+			Value: data[syscall.SizeofRtAttr:attr.Len],
+			Raw:   data[:attr.Len],
+		})
+		if rtaAlign(int(attr.Len)) >= len(data) {
+			break
+		}
+		data = data[rtaAlign(int(attr.Len)):]
+	}
+	return attrs
+}
+
+// tupleSource returns the IPv4 source address of a conntrack tuple.
+func tupleSource(tuple []byte) ([4]byte, bool) {
+	var addr [4]byte
+	for _, attr := range parseNetlinkAttrs(tuple) {
+		if attr.Type != ctaTupleIP {
+			continue
+		}
+		for _, ipAttr := range parseNetlinkAttrs(attr.Value) {
+			if ipAttr.Type == ctaIPv4Src && len(ipAttr.Value) == 4 {
+				copy(addr[:], ipAttr.Value)
+				return addr, true
+			}
+		}
+	}
+	return addr, false
+}
+
+// conntrackDeletion returns the attributes of the request deleting the
+// conntrack entry in data, the body of a ctnetlink message, if either of its
+// tuples has one of ips as source.
+func conntrackDeletion(data []byte, ips map[[4]byte]bool) ([]byte, bool) {
+	if len(data) < sizeofNfgenmsg {
+		return nil, false
+	}
+	var orig, zone []byte
+	var matches bool
+	for _, attr := range parseNetlinkAttrs(data[sizeofNfgenmsg:]) {
+		switch attr.Type {
+		case ctaTupleOrig, ctaTupleReply:
+			if src, ok := tupleSource(attr.Value); ok && ips[src] {
+				matches = true
+			}
+			if attr.Type == ctaTupleOrig {
+				orig = attr.Raw
+			}
+		case ctaZone:
+			zone = attr.Raw
+		}
+	}
+	if !matches || orig == nil {
+		return nil, false
+	}
+	attrs := make([]byte, rtaAlign(len(orig)), rtaAlign(len(orig))+rtaAlign(len(zone)))
+	copy(attrs, orig)
+	if zone != nil {
+		padded := make([]byte, rtaAlign(len(zone)))
+		copy(padded, zone)
+		attrs = append(attrs, padded...)
+	}
+	return attrs, true
+}
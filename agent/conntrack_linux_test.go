@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"context"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"gopkg.in/check.v1"
+)
+
+func netlinkAttrBytes(attrType uint16, value []byte) []byte {
+	attr := make([]byte, rtaAlign(syscall.SizeofRtAttr+len(value)))
+	*(*syscall.RtAttr)(unsafe.Pointer(&attr[0])) = syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(value)), Type: attrType}
+	copy(attr[syscall.SizeofRtAttr:], value)
+	return attr
+}
+
+func conntrackTuple(attrType uint16, src, dst [4]byte) []byte {
+	ip := append(netlinkAttrBytes(ctaIPv4Src, src[:]), netlinkAttrBytes(2, dst[:])...)
+	proto := netlinkAttrBytes(1, []byte{syscall.IPPROTO_TCP})
+	tuple := append(netlinkAttrBytes(ctaTupleIP|0x8000, ip), netlinkAttrBytes(2|0x8000, proto)...)
+	return netlinkAttrBytes(attrType|0x8000, tuple)
+}
+
+func (s *S) TestConntrackDeletion(c *check.C) {
+	client := [4]byte{192, 168, 5, 1}
+	backend := [4]byte{10, 0, 0, 1}
+	orig := conntrackTuple(ctaTupleOrig, client, backend)
+	zone := netlinkAttrBytes(ctaZone, []byte{0, 1})
+	data := append([]byte{syscall.AF_INET, 0, 0, 0}, orig...)
+	data = append(data, conntrackTuple(ctaTupleReply, backend, client)...)
+	data = append(data, zone...)
+	data = append(data, netlinkAttrBytes(3, []byte{0, 0, 0, 2})...)
+	attrs, ok := conntrackDeletion(data, map[[4]byte]bool{backend: true})
+	c.Assert(ok, check.Equals, true)
+	c.Assert(attrs, check.DeepEquals, append(append([]byte{}, orig...), zone...))
+	attrs, ok = conntrackDeletion(data, map[[4]byte]bool{client: true})
+	c.Assert(ok, check.Equals, true)
+	_, ok = conntrackDeletion(data, map[[4]byte]bool{{10, 0, 0, 2}: true})
+	c.Assert(ok, check.Equals, false)
+	_, ok = conntrackDeletion(data[:2], map[[4]byte]bool{backend: true})
+	c.Assert(ok, check.Equals, false)
+}
+
+func netlinkMessageBytes(msgType, flags uint16, seq uint32, data []byte) []byte {
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(data))
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&msg[0])) = syscall.NlMsghdr{
+		Len:   uint32(len(msg)),
+		Type:  msgType,
+		Flags: flags,
+		Seq:   seq,
+	}
+	copy(msg[syscall.NLMSG_HDRLEN:], data)
+	return msg
+}
+
+// fakeCtnetlink answers conntrack requests read from fd, dumping entries and
+// acknowledging deletions, failing the ones in missing with ENOENT. It
+// returns the deleted entries.
+func fakeCtnetlink(fd int, entries [][]byte, missing map[int]bool) <-chan [][]byte {
+	deletedCh := make(chan [][]byte, 1)
+	go func() {
+		var deleted [][]byte
+		defer func() { deletedCh <- deleted }()
+		buf := make([]byte, 64*1024)
+		for req := 0; ; req++ {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EAGAIN {
+				time.Sleep(time.Millisecond)
+				req--
+				continue
+			}
+			if err != nil || n == 0 {
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil || len(msgs) != 1 {
+				return
+			}
+			hdr := msgs[0].Header
+			var reply []byte
+			switch hdr.Type & 0xff {
+			case ipctnlMsgCtGet:
+				// A multipart dump split in two reads.
+				first := netlinkMessageBytes(hdr.Type, syscall.NLM_F_MULTI, hdr.Seq, entries[0])
+				syscall.Write(fd, first)
+				for _, entry := range entries[1:] {
+					reply = append(reply, netlinkMessageBytes(hdr.Type, syscall.NLM_F_MULTI, hdr.Seq, entry)...)
+				}
+				reply = append(reply, netlinkMessageBytes(syscall.NLMSG_DONE, syscall.NLM_F_MULTI, hdr.Seq, make([]byte, 4))...)
+			case ipctnlMsgCtDelete:
+				errno := int32(0)
+				if missing[req] {
+					errno = -int32(syscall.ENOENT)
+				} else {
+					deleted = append(deleted, append([]byte{}, msgs[0].Data[sizeofNfgenmsg:]...))
+				}
+				ack := make([]byte, 4+syscall.NLMSG_HDRLEN)
+				*(*int32)(unsafe.Pointer(&ack[0])) = errno
+				reply = netlinkMessageBytes(syscall.NLMSG_ERROR, 0, hdr.Seq, ack)
+			}
+			syscall.Write(fd, reply)
+		}
+	}()
+	return deletedCh
+}
+
+func conntrackEntry(src, dst [4]byte) []byte {
+	entry := append([]byte{syscall.AF_INET, 0, 0, 0}, conntrackTuple(ctaTupleOrig, src, dst)...)
+	return append(entry, conntrackTuple(ctaTupleReply, dst, src)...)
+}
+
+func (s *S) TestFlushConntrackEntries(c *check.C) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	c.Assert(err, check.IsNil)
+	defer syscall.Close(fds[1])
+	file, err := newPollFile(fds[0])
+	c.Assert(err, check.IsNil)
+	client := [4]byte{192, 168, 5, 1}
+	entries := [][]byte{
+		conntrackEntry(client, [4]byte{10, 0, 0, 1}),
+		conntrackEntry(client, [4]byte{10, 0, 0, 2}),
+		conntrackEntry([4]byte{10, 0, 0, 3}, client),
+		conntrackEntry(client, [4]byte{10, 0, 0, 4}),
+	}
+	// The second deletion, request 2, finds the connection already closed.
+	deletedCh := fakeCtnetlink(fds[1], entries, map[int]bool{2: true})
+	wanted := map[[4]byte]bool{{10, 0, 0, 1}: true, {10, 0, 0, 3}: true, {10, 0, 0, 4}: true}
+	deleted, err := flushConntrackEntries(context.Background(), &netfilterConn{file: file}, wanted)
+	c.Assert(err, check.IsNil)
+	c.Assert(deleted, check.Equals, 2)
+	file.Close()
+	syscall.Shutdown(fds[1], syscall.SHUT_RDWR)
+	c.Assert(<-deletedCh, check.DeepEquals, [][]byte{
+		conntrackTuple(ctaTupleOrig, client, [4]byte{10, 0, 0, 1}),
+		conntrackTuple(ctaTupleOrig, client, [4]byte{10, 0, 0, 4}),
+	})
+}
+
+func (s *S) TestFlushConntrackEntriesCanceled(c *check.C) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	c.Assert(err, check.IsNil)
+	defer syscall.Close(fds[1])
+	file, err := newPollFile(fds[0])
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		// Nobody answers the dump request.
+		_, err := flushConntrackEntries(ctx, &netfilterConn{file: file}, map[[4]byte]bool{{10, 0, 0, 1}: true})
+		errCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err = <-errCh:
+		c.Assert(err, check.Equals, context.Canceled)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for the flush to be canceled")
+	}
+}
+
+func (s *RealS) TestFlushConntrack(c *check.C) {
+	flushed, err := flushConntrack(context.Background(), "/var/run/netns/"+testNetNamespace, []string{"10.9.9.1"})
+	if err == syscall.EPROTONOSUPPORT {
+		c.Skip("conntrack netlink not supported")
+	}
+	c.Assert(err, check.IsNil)
+	c.Assert(flushed, check.Equals, 0)
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultContainerdPollInterval is how often tasks are listed, when watching
+// containerd for changes, if no interval is given.
+const DefaultContainerdPollInterval = 5 * time.Second
+
+// containerdSource lists containers from containerd using its ctr client,
+// reading the addresses directly from the network namespace of their tasks.
+// As ctr has no way to stream events to a non-interactive caller, changes are
+// watched by polling the task list every interval.
+type containerdSource struct {
+	address     string
+	namespace   string
+	labelFilter string
+	interval    time.Duration
+	executor    Executor
+}
+
+var _ ContainerSource = &containerdSource{}
+
+type containerdTask struct {
+	pid    string
+	status string
+}
+
+func (s *containerdSource) ctr(ctx context.Context, args ...string) ([]byte, error) {
+	return executorOrDefault(s.executor).Exec(ctx, "ctr", append([]string{"--address", s.address, "--namespace", s.namespace}, args...)...)
+}
+
+func (s *containerdSource) List(ctx context.Context) ([]Workload, error) {
+	key, value, err := parseLabelFilter(s.labelFilter)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf("labels.%s", strconv.Quote(key))
+	if value != "" {
+		filter += "==" + strconv.Quote(value)
+	}
+	out, err := s.ctr(ctx, "containers", "list", "--quiet", filter)
+	if err != nil {
+		return nil, fmt.Errorf("error listing containers: %s", err)
+	}
+	tasks, err := s.tasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var workloads []Workload
+	for _, id := range strings.Fields(string(out)) {
+		task, ok := tasks[id]
+		if !ok || task.status != "RUNNING" {
+			continue
+		}
+		var info struct {
+			Labels map[string]string
+		}
+		out, err = s.ctr(ctx, "containers", "info", id)
+		if err != nil {
+			log.Printf("error inspecting container: %s", err)
+			continue
+		}
+		err = json.Unmarshal(out, &info)
+		if err != nil {
+			log.Printf("error parsing container %s info: %s", id, err)
+			continue
+		}
+		ips, err := s.taskIPs(ctx, task.pid)
+		if err != nil {
+			log.Printf("error reading container %s addresses: %s", id, err)
+			continue
+		}
+		workloads = append(workloads, Workload{
+			ID:     id,
+			Name:   id,
+			Labels: info.Labels,
+			IPs:    ips,
+		})
+	}
+	return workloads, nil
+}
+
+func (s *containerdSource) Watch(changes chan<- struct{}, stop <-chan struct{}) error {
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+	interval := s.interval
+	if interval <= 0 {
+		interval = DefaultContainerdPollInterval
+	}
+	last, err := s.tasks(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+		current, err := s.tasks(ctx)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(last, current) {
+			notifyChange(changes)
+		}
+		last = current
+	}
+}
+
+func (s *containerdSource) tasks(ctx context.Context) (map[string]containerdTask, error) {
+	out, err := s.ctr(ctx, "tasks", "list")
+	if err != nil {
+		return nil, fmt.Errorf("error listing tasks: %s", err)
+	}
+	tasks, err := parseTaskList(out)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tasks: %s", err)
+	}
+	return tasks, nil
+}
+
+// parseTaskList parses the tasks listed by ctr, by container ID. ctr only
+// lists tasks as a table, its columns are found by their names in the header
+// instead of their positions.
+func parseTaskList(out []byte) (map[string]containerdTask, error) {
+	tasks := make(map[string]containerdTask)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if lines[0] == "" {
+		return tasks, nil
+	}
+	header := strings.Fields(lines[0])
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	idCol, hasID := columns["TASK"]
+	pidCol, hasPid := columns["PID"]
+	statusCol, hasStatus := columns["STATUS"]
+	if !hasID || !hasPid || !hasStatus {
+		return nil, fmt.Errorf("unexpected header %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != len(header) {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[pidCol]); err != nil {
+			continue
+		}
+		tasks[fields[idCol]] = containerdTask{pid: fields[pidCol], status: fields[statusCol]}
+	}
+	return tasks, nil
+}
+
+// taskIPs returns the global IPv4 addresses in the network namespace of the
+// process with the given pid, read from the JSON output of ip.
+func (s *containerdSource) taskIPs(ctx context.Context, pid string) ([]string, error) {
+	out, err := executorOrDefault(s.executor).Exec(ctx, "nsenter", "--target", pid, "--net", "ip", "-j", "-4", "addr", "show", "scope", "global")
+	if err != nil {
+		return nil, err
+	}
+	var links []struct {
+		AddrInfo []struct {
+			Family string `json:"family"`
+			Local  string `json:"local"`
+		} `json:"addr_info"`
+	}
+	err = json.Unmarshal(out, &links)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing addresses: %s", err)
+	}
+	var ips []string
+	for _, link := range links {
+		for _, addr := range link.AddrInfo {
+			ip := net.ParseIP(addr.Local)
+			if addr.Family == "inet" && ip != nil && ip.To4() != nil {
+				ips = append(ips, ip.String())
+			}
+		}
+	}
+	return ips, nil
+}
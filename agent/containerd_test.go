@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestContainerdSourceList(c *check.C) {
+	s.executor.results = map[string]fakeResult{
+		`ctr --address /run/containerd/containerd.sock --namespace k8s.io containers list --quiet labels."router"=="fusis"`: {
+			data: []byte("c1\nc2\nc3\nc4\n"),
+		},
+		"ctr --address /run/containerd/containerd.sock --namespace k8s.io tasks list": {
+			data: []byte("TASK    PID     STATUS\nc1      100     RUNNING\nc2      200     STOPPED\nc4      400     RUNNING\nother   500     RUNNING\n"),
+		},
+		"ctr --address /run/containerd/containerd.sock --namespace k8s.io containers info c1": {
+			data: []byte(`{"ID": "c1", "Labels": {"router": "fusis", "app": "web"}}`),
+		},
+		"ctr --address /run/containerd/containerd.sock --namespace k8s.io containers info c4": {
+			data: []byte(`{"ID": "c4", "Labels": {"router": "fusis"}}`),
+		},
+		"nsenter --target 100 --net ip -j -4 addr show scope global": {
+			data: []byte(`[{"ifindex": 2, "ifname": "eth0", "addr_info": [{"family": "inet", "local": "10.4.0.5", "prefixlen": 24, "scope": "global"}]},
+  {"ifindex": 3, "ifname": "eth1", "addr_info": [{"family": "inet", "local": "10.5.0.5", "prefixlen": 16, "scope": "global"}]}]`),
+		},
+		"nsenter --target 400 --net ip -j -4 addr show scope global": {
+			err: errors.New("exit 1"),
+		},
+	}
+	src := containerdSource{
+		address:     "/run/containerd/containerd.sock",
+		namespace:   "k8s.io",
+		labelFilter: "router=fusis",
+		executor:    s.executor,
+	}
+	workloads, err := src.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{ID: "c1", Name: "c1", Labels: map[string]string{"router": "fusis", "app": "web"}, IPs: []string{"10.4.0.5", "10.5.0.5"}},
+	})
+}
+
+func (s *S) TestContainerdSourceListKeyOnlyFilter(c *check.C) {
+	s.executor.results = map[string]fakeResult{
+		`ctr --address /run/containerd/containerd.sock --namespace default containers list --quiet labels."router"`: {
+			err: errors.New("exit 1"),
+		},
+	}
+	src := containerdSource{
+		address:     "/run/containerd/containerd.sock",
+		namespace:   "default",
+		labelFilter: "router",
+		executor:    s.executor,
+	}
+	_, err := src.List(context.Background())
+	c.Assert(err, check.ErrorMatches, "error listing containers: exit 1")
+}
+
+func (s *S) TestParseTaskList(c *check.C) {
+	tasks, err := parseTaskList([]byte("PID     TASK    STATUS\n100     c1      RUNNING\nbad     c2      RUNNING\n300     c3\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(tasks, check.DeepEquals, map[string]containerdTask{"c1": {pid: "100", status: "RUNNING"}})
+	tasks, err = parseTaskList(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(tasks, check.HasLen, 0)
+	_, err = parseTaskList([]byte("ID      STATUS\nc1      RUNNING\n"))
+	c.Assert(err, check.ErrorMatches, `unexpected header "ID      STATUS"`)
+}
+
+func (s *S) TestContainerdSourceWatch(c *check.C) {
+	key := "ctr --address /run/containerd/containerd.sock --namespace default tasks list"
+	s.executor.results = map[string]fakeResult{
+		key: {data: []byte("TASK    PID     STATUS\n")},
+	}
+	src := containerdSource{
+		address:     "/run/containerd/containerd.sock",
+		namespace:   "default",
+		labelFilter: "router=fusis",
+		interval:    time.Millisecond,
+		executor:    s.executor,
+	}
+	changes := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- src.Watch(changes, stop)
+	}()
+	select {
+	case <-changes:
+		c.Fatal("unexpected change notification")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
+
+func (s *S) TestAgentInitContainerd(c *check.C) {
+	a := Agent{
+		Runtime:      RuntimeContainerd,
+		FusisAddress: "10.0.0.1",
+		LabelFilter:  "router=fusis",
+		Interval:     time.Second,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, "containerd address is mandatory")
+	a.ContainerdAddress = "/run/containerd/containerd.sock"
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, "containerd namespace is mandatory")
+	a.ContainerdNamespace = "default"
+	a.LabelFilter = "=fusis"
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, `invalid label filter "=fusis"`)
+	a.LabelFilter = "router=fusis"
+	a.ContainerdPollInterval = time.Second
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	c.Assert(a.source, check.DeepEquals, &containerdSource{
+		address:     "/run/containerd/containerd.sock",
+		namespace:   "default",
+		labelFilter: "router=fusis",
+		interval:    time.Second,
+		executor:    s.executor,
+	})
+	a.Runtime = "rkt"
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, `unknown container runtime "rkt"`)
+}
@@ -0,0 +1,668 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// minDockerAPIVersion is the oldest docker remote API version which includes
+// network information when listing containers.
+const minDockerAPIVersion = "1.22"
+
+// swarmTaskLabel and swarmServiceLabel are added by docker to every container
+// created for a swarm service task.
+const (
+	swarmTaskLabel    = "com.docker.swarm.task.id"
+	swarmServiceLabel = "com.docker.swarm.service.id"
+)
+
+// hostPortsLabel lists the ports served by a container using the host
+// network, as in "80,53/udp". Its exposed ports are used if not set.
+const hostPortsLabel = "fusis.ports"
+
+// dockerInspectWorkers limits the concurrent inspect calls made for
+// containers missing from the inspect cache.
+var dockerInspectWorkers = 8
+
+func (a *Agent) newDockerClient() (*docker.Client, error) {
+	if a.DockerAPIVersion != "" {
+		requested, err := docker.NewAPIVersion(a.DockerAPIVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid docker API version: %s", err)
+		}
+		minVersion, _ := docker.NewAPIVersion(minDockerAPIVersion)
+		if requested.LessThan(minVersion) {
+			return nil, fmt.Errorf("docker API version %s is not supported, minimum version is %s", requested, minVersion)
+		}
+	}
+	useTLS := a.DockerTLSCert != "" || a.DockerTLSKey != "" || a.DockerTLSCA != ""
+	if useTLS {
+		// The client reads all of them, an empty path would only be reported
+		// as a file not found.
+		var missing []string
+		for _, f := range []struct{ flag, file string }{
+			{"--docker-tls-cert", a.DockerTLSCert},
+			{"--docker-tls-key", a.DockerTLSKey},
+			{"--docker-tls-ca", a.DockerTLSCA},
+		} {
+			if f.file == "" {
+				missing = append(missing, f.flag)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("docker TLS requires %s to be set", strings.Join(missing, " and "))
+		}
+	}
+	for _, file := range []string{a.DockerTLSCert, a.DockerTLSKey, a.DockerTLSCA} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("unable to use docker TLS file: %s", err)
+		}
+	}
+	var client *docker.Client
+	var err error
+	switch {
+	case useTLS:
+		address := a.DockerAddress
+		if address == "" {
+			address = os.Getenv("DOCKER_HOST")
+		}
+		client, err = docker.NewVersionedTLSClient(address, a.DockerTLSCert, a.DockerTLSKey, a.DockerTLSCA, a.DockerAPIVersion)
+	case a.DockerAddress == "":
+		client, err = docker.NewVersionedClientFromEnv(a.DockerAPIVersion)
+	default:
+		client, err = docker.NewVersionedClient(a.DockerAddress, a.DockerAPIVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Version negotiation is done by dockerSource.checkAPIVersion, before the
+	// first call to the daemon.
+	client.SkipServerVersionCheck = true
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	client.Dialer = dialer
+	client.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Dial:                dialer.Dial,
+			TLSClientConfig:     client.TLSConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: -1,
+			DisableKeepAlives:   true,
+		},
+		Timeout: time.Minute,
+	}
+	return client, nil
+}
+
+// dockerSource lists containers from the local docker daemon. By default the
+// container address in the bridge network is used. When swarm is set only
+// containers running tasks of swarm services matching the label filter are
+// listed, using their address in the given network, usually an overlay
+// network shared by the service.
+type dockerSource struct {
+	client           *docker.Client
+	labelFilter      string
+	requestedVersion string
+	network          string
+	swarm            bool
+	// cgroups enables resolving the cgroup of containers using the host
+	// network, so they're marked by cgroup instead of port.
+	cgroups bool
+
+	mu            sync.Mutex
+	serverVersion docker.APIVersion
+	// cgroupWarned are the listed containers already reported as marked by
+	// address despite cgroups being set.
+	cgroupWarned map[string]struct{}
+
+	// inspectCache keeps what's used from inspecting listed containers whose
+	// address, or ports, are only available this way. Entries are
+	// invalidated by docker events, cacheGen is incremented on every
+	// invalidation.
+	cacheMu      sync.Mutex
+	inspectCache map[string]*dockerInspect
+	cacheGen     uint64
+}
+
+var _ ContainerSource = &dockerSource{}
+
+// dockerInspect is what's used from inspecting a container.
+type dockerInspect struct {
+	settings     *docker.NetworkSettings
+	exposedPorts []string
+	cgroup       string
+	pid          int
+}
+
+// dockerAddr is the address of a container, or the ports it serves and its
+// cgroup if it uses the host network.
+type dockerAddr struct {
+	ip     string
+	ports  []string
+	cgroup string
+	pid    int
+}
+
+// dockerEventActions are the container and network event actions which may
+// change the list of running containers, their addresses or health.
+var dockerEventActions = map[string]struct{}{
+	"start":         {},
+	"health_status": {},
+	"die":           {},
+	"destroy":       {},
+	"pause":         {},
+	"unpause":       {},
+	"connect":       {},
+	"disconnect":    {},
+}
+
+// dockerCall runs fn, a request to the daemon, returning early when ctx is
+// done. The docker client doesn't support contexts, so an abandoned request is
+// still bounded by the client timeout.
+func dockerCall(ctx context.Context, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *dockerSource) List(ctx context.Context) ([]Workload, error) {
+	err := dockerCall(ctx, s.checkAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	labels := []string{s.labelFilter}
+	var services map[string]map[string]string
+	if s.swarm {
+		services, err = s.swarmServices(ctx)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, swarmTaskLabel)
+		if services != nil {
+			labels = []string{swarmServiceLabel}
+		}
+	}
+	opts := docker.ListContainersOptions{
+		Filters: map[string][]string{"label": labels},
+	}
+	var conts []docker.APIContainers
+	err = dockerCall(ctx, func() (err error) {
+		conts, err = s.client.ListContainers(opts)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing containers: %s", err)
+	}
+	if services != nil {
+		conts = serviceContainers(conts, services)
+	}
+	addrs, err := s.containerAddrs(ctx, conts)
+	if err != nil {
+		return nil, err
+	}
+	if s.cgroups {
+		s.warnCgroupUnused(conts)
+	}
+	var workloads []Workload
+	for i, c := range conts {
+		addr := addrs[i]
+		if addr.ip == "" && len(addr.ports) == 0 && addr.cgroup == "" {
+			continue
+		}
+		var name string
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if taskName := c.Labels["com.docker.swarm.task.name"]; taskName != "" {
+			name = taskName
+		}
+		w := Workload{
+			ID:      c.ID,
+			Name:    name,
+			Labels:  c.Labels,
+			Network: s.networkName(),
+			Health:  containerHealth(c.Status),
+		}
+		if addr.ip != "" {
+			w.IPs = []string{addr.ip}
+		} else {
+			w.Network = "host"
+			w.HostPorts = addr.ports
+			w.Cgroup = addr.cgroup
+			w.Pid = addr.pid
+		}
+		workloads = append(workloads, w)
+	}
+	return workloads, nil
+}
+
+// warnCgroupUnused logs the containers outside the host network, once each,
+// as cgroup matching only applies to packets sent from host network sockets.
+// Other containers are still marked by address.
+func (s *dockerSource) warnCgroupUnused(conts []docker.APIContainers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	warned := make(map[string]struct{})
+	for i := range conts {
+		c := &conts[i]
+		if isHostNetwork(c) {
+			continue
+		}
+		if _, ok := s.cgroupWarned[c.ID]; !ok {
+			log.Printf("cgroup matching has no effect on container %s outside the host network, marking it by address", c.ID)
+		}
+		warned[c.ID] = struct{}{}
+	}
+	s.cgroupWarned = warned
+}
+
+// swarmServices returns the labels of the swarm services matching the label
+// filter, by service ID. Services are only listed by managers, nil is returned
+// by worker nodes, where the labels of task containers are matched instead, as
+// set by "docker service create --container-label".
+func (s *dockerSource) swarmServices(ctx context.Context) (map[string]map[string]string, error) {
+	rsp, err := s.apiGet(ctx, "/services", map[string][]string{"label": {s.labelFilter}})
+	if err != nil {
+		return nil, fmt.Errorf("error listing services: %s", err)
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable, http.StatusNotFound:
+		return nil, nil
+	default:
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return nil, fmt.Errorf("error listing services: unexpected status %d: %s", rsp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var list []struct {
+		ID   string
+		Spec struct {
+			Labels map[string]string
+		}
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding services: %s", err)
+	}
+	services := make(map[string]map[string]string, len(list))
+	for _, svc := range list {
+		services[svc.ID] = svc.Spec.Labels
+	}
+	return services, nil
+}
+
+// serviceContainers returns the task containers of the given services, with
+// the service labels added to their own.
+func serviceContainers(conts []docker.APIContainers, services map[string]map[string]string) []docker.APIContainers {
+	var result []docker.APIContainers
+	for _, c := range conts {
+		serviceLabels, ok := services[c.Labels[swarmServiceLabel]]
+		if !ok {
+			continue
+		}
+		labels := make(map[string]string, len(c.Labels)+len(serviceLabels))
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		for k, v := range serviceLabels {
+			labels[k] = v
+		}
+		c.Labels = labels
+		result = append(result, c)
+	}
+	return result
+}
+
+// containerAddrs returns the address of each container in the network used
+// by the source, or the ports served by containers using the host network.
+// Containers whose address, or ports, are not in the list result are
+// inspected, using the cache when possible. During rolling updates a replaced
+// swarm task may still be listed while it's being stopped, it's kept until it
+// dies as it may still be serving traffic.
+func (s *dockerSource) containerAddrs(ctx context.Context, conts []docker.APIContainers) ([]dockerAddr, error) {
+	addrs := make([]dockerAddr, len(conts))
+	inspects := make([]*dockerInspect, len(conts))
+	var misses []int
+	s.cacheMu.Lock()
+	gen := s.cacheGen
+	for i := range conts {
+		if addr, ok := s.listedAddr(&conts[i]); ok {
+			addrs[i] = addr
+		} else if cached, ok := s.inspectCache[conts[i].ID]; ok {
+			inspects[i] = cached
+		} else {
+			misses = append(misses, i)
+		}
+	}
+	s.cacheMu.Unlock()
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < dockerInspectWorkers && w < len(misses); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				var cont *docker.Container
+				err := dockerCall(ctx, func() (err error) {
+					cont, err = s.client.InspectContainer(conts[i].ID)
+					return err
+				})
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("error inspecting container: %s", err.Error())
+					}
+					continue
+				}
+				inspect := newDockerInspect(cont)
+				if s.cgroups && isHostNetwork(&conts[i]) {
+					inspect.cgroup, err = processCgroup(inspect.pid)
+					if err != nil {
+						log.Printf("error resolving cgroup of container %s, marking it by port: %s", conts[i].ID, err)
+					}
+				}
+				inspects[i] = inspect
+			}
+		}()
+	}
+feed:
+	for _, i := range misses {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	// Only listed containers are kept, new results are discarded if entries
+	// were invalidated while inspecting.
+	cache := make(map[string]*dockerInspect)
+	for i, c := range conts {
+		if inspects[i] == nil {
+			continue
+		}
+		if _, cached := s.inspectCache[c.ID]; cached || gen == s.cacheGen {
+			cache[c.ID] = inspects[i]
+		}
+		if isHostNetwork(&c) {
+			addrs[i] = dockerAddr{ports: inspects[i].exposedPorts}
+			if inspects[i].cgroup != "" {
+				addrs[i].cgroup = inspects[i].cgroup
+				addrs[i].pid = inspects[i].pid
+			}
+			if ports, ok := labeledPorts(&c); ok {
+				addrs[i].ports = ports
+			}
+		} else {
+			addrs[i].ip = s.networkIP(inspects[i].settings)
+		}
+	}
+	s.inspectCache = cache
+	return addrs, nil
+}
+
+func newDockerInspect(cont *docker.Container) *dockerInspect {
+	inspect := &dockerInspect{settings: cont.NetworkSettings}
+	if inspect.settings == nil {
+		inspect.settings = &docker.NetworkSettings{}
+	}
+	if cont.State.Running {
+		inspect.pid = cont.State.Pid
+	}
+	if cont.Config != nil {
+		// Only tcp and udp ports are marked, others such as sctp are skipped.
+		for port := range cont.Config.ExposedPorts {
+			if ports, err := parsePorts(string(port)); err == nil {
+				inspect.exposedPorts = append(inspect.exposedPorts, ports...)
+			}
+		}
+		sort.Strings(inspect.exposedPorts)
+	}
+	return inspect
+}
+
+// labeledPorts returns the ports in the hostPortsLabel of the container, if
+// set. No ports are returned if the label is invalid.
+func labeledPorts(c *docker.APIContainers) ([]string, bool) {
+	label, ok := c.Labels[hostPortsLabel]
+	if !ok {
+		return nil, false
+	}
+	ports, err := parsePorts(label)
+	if err != nil {
+		log.Printf("ignoring ports of container %s using the host network: invalid %s label: %s", c.ID, hostPortsLabel, err)
+	}
+	return ports, true
+}
+
+// isHostNetwork returns whether the container uses the host network.
+func isHostNetwork(c *docker.APIContainers) bool {
+	_, ok := c.Networks.Networks["host"]
+	return ok
+}
+
+// networkName returns the name of the network used by the source.
+func (s *dockerSource) networkName() string {
+	if s.network == "" {
+		return "bridge"
+	}
+	return s.network
+}
+
+// listedAddr returns the container address in the network used by the
+// source, or the ports labeled in a container using the host network, if
+// they're available in the list result. The cgroup is only available by
+// inspecting the container.
+func (s *dockerSource) listedAddr(c *docker.APIContainers) (dockerAddr, bool) {
+	if isHostNetwork(c) {
+		if s.cgroups {
+			return dockerAddr{}, false
+		}
+		ports, ok := labeledPorts(c)
+		return dockerAddr{ports: ports}, ok
+	}
+	endpoint, ok := c.Networks.Networks[s.networkName()]
+	return dockerAddr{ip: endpoint.IPAddress}, ok
+}
+
+func (s *dockerSource) networkIP(settings *docker.NetworkSettings) string {
+	if s.network == "" {
+		return settings.IPAddress
+	}
+	return settings.Networks[s.network].IPAddress
+}
+
+// invalidate removes the container from the inspect cache, or every
+// container if id is empty.
+func (s *dockerSource) invalidate(id string) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	s.cacheGen++
+	if id == "" {
+		s.inspectCache = nil
+		return
+	}
+	delete(s.inspectCache, id)
+}
+
+func (s *dockerSource) Watch(changes chan<- struct{}, stop <-chan struct{}) error {
+	err := s.checkAPIVersion()
+	if err != nil {
+		return err
+	}
+	// Events may have been missed while not watching.
+	s.invalidate("")
+	return s.streamEvents(stop, func(ev *docker.APIEvents) {
+		action := ev.Action
+		if action == "" {
+			action = ev.Status
+		}
+		// Service labels may change without replacing its tasks.
+		if ev.Type == "service" {
+			notifyChange(changes)
+			return
+		}
+		// Health events include the new status, as in "health_status: healthy".
+		action = strings.SplitN(action, ":", 2)[0]
+		if _, isRelevant := dockerEventActions[action]; isRelevant {
+			s.invalidate(eventContainerID(ev))
+			notifyChange(changes)
+		}
+	})
+}
+
+// eventContainerID returns the id of the container affected by ev, which is
+// an attribute in network events.
+func eventContainerID(ev *docker.APIEvents) string {
+	if ev.Type == "network" {
+		return ev.Actor.Attributes["container"]
+	}
+	if ev.Actor.ID != "" {
+		return ev.Actor.ID
+	}
+	return ev.ID
+}
+
+// streamEvents calls fn for each container or network event, and service
+// event when using swarm, received from the docker daemon, until stop is
+// closed or the stream is interrupted. Events are read directly from the API
+// because the event monitor in go-dockerclient may panic when its listeners
+// are removed or the daemon closes the stream.
+func (s *dockerSource) streamEvents(stop <-chan struct{}, fn func(*docker.APIEvents)) error {
+	types := []string{"container", "network"}
+	if s.swarm {
+		types = append(types, "service")
+	}
+	// Canceling the request also interrupts reading the response body.
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+	rsp, err := s.apiGet(ctx, "/events", map[string][]string{"type": types})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("unexpected status %d reading docker events: %s", rsp.StatusCode, string(data))
+	}
+	decoder := json.NewDecoder(rsp.Body)
+	for {
+		var ev docker.APIEvents
+		err = decoder.Decode(&ev)
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if err == io.EOF {
+				return errors.New("docker events stream closed")
+			}
+			return err
+		}
+		fn(&ev)
+	}
+}
+
+// apiGet requests path from the docker API directly, for endpoints missing
+// from go-dockerclient or badly handled by it. The response status is left for
+// the caller to check.
+func (s *dockerSource) apiGet(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	endpoint, err := url.Parse(s.client.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	dial := s.client.Dialer.Dial
+	scheme, host := "http", endpoint.Host
+	if endpoint.Scheme == "unix" {
+		host = "docker"
+		dial = func(string, string) (net.Conn, error) {
+			return s.client.Dialer.Dial("unix", endpoint.Path)
+		}
+	} else if s.client.TLSConfig != nil {
+		scheme = "https"
+	}
+	if s.requestedVersion != "" {
+		path = "/v" + s.requestedVersion + path
+	}
+	data, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Dial:              dial,
+			TLSClientConfig:   s.client.TLSConfig,
+			DisableKeepAlives: true,
+		},
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s%s?filters=%s", scheme, host, path, url.QueryEscape(string(data))), nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req.WithContext(ctx))
+}
+
+// checkAPIVersion ensures the docker daemon supports the API version required
+// by the agent. When a version is requested by the user the daemon itself
+// refuses requests newer than what it supports. The check is only done once,
+// after the first success the server version is kept.
+func (s *dockerSource) checkAPIVersion() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.serverVersion != nil {
+		return nil
+	}
+	env, err := s.client.Version()
+	if err != nil {
+		if s.requestedVersion != "" {
+			return fmt.Errorf("unable to use docker API version %s: %s", s.requestedVersion, err)
+		}
+		return err
+	}
+	serverVersion, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		return fmt.Errorf("unable to parse docker daemon API version: %s", err)
+	}
+	minVersion, _ := docker.NewAPIVersion(minDockerAPIVersion)
+	if serverVersion.LessThan(minVersion) {
+		return fmt.Errorf("docker daemon API version %s is too old, minimum version is %s", serverVersion, minVersion)
+	}
+	s.serverVersion = serverVersion
+	return nil
+}
@@ -0,0 +1,402 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	dockerTesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+func writeTLSFiles(c *check.C, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fusis-agent"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	c.Assert(err, check.IsNil)
+	return certFile, keyFile
+}
+
+func (s *S) TestAgentInitDockerFromEnv(c *check.C) {
+	oldHost := os.Getenv("DOCKER_HOST")
+	defer os.Setenv("DOCKER_HOST", oldHost)
+	os.Setenv("DOCKER_HOST", "ftp://localhost")
+	a := Agent{
+		FusisAddress: "10.0.0.1",
+		LabelFilter:  "router=fusis",
+		Interval:     time.Second,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, "invalid endpoint")
+	os.Setenv("DOCKER_HOST", "tcp://localhost:2375")
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	c.Assert(a.source.(*dockerSource).client.Endpoint(), check.Equals, "tcp://localhost:2375")
+}
+
+func (s *S) TestAgentInitDockerTLS(c *check.C) {
+	dir, err := ioutil.TempDir("", "dockertls")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTLSFiles(c, dir)
+	a := Agent{
+		DockerAddress: "localhost:2376",
+		DockerTLSCert: certFile,
+		DockerTLSKey:  keyFile,
+		DockerTLSCA:   filepath.Join(dir, "missing.pem"),
+		FusisAddress:  "10.0.0.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Second,
+	}
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, "unable to use docker TLS file: .*missing.pem: no such file or directory")
+	a.DockerTLSKey = ""
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, "docker TLS requires --docker-tls-key to be set")
+	a.DockerTLSCert = ""
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, "docker TLS requires --docker-tls-cert and --docker-tls-key to be set")
+	a.DockerTLSCert, a.DockerTLSKey, a.DockerTLSCA = certFile, keyFile, ""
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, "docker TLS requires --docker-tls-ca to be set")
+	a.DockerTLSCA = filepath.Join(dir, "missing.pem")
+	a.DockerTLSCA = keyFile
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, "(?i)could not add RootCA pem")
+	a.DockerTLSCA = certFile
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	client := a.source.(*dockerSource).client
+	c.Assert(client.TLSConfig, check.NotNil)
+	c.Assert(client.TLSConfig.Certificates, check.HasLen, 1)
+	c.Assert(client.TLSConfig.RootCAs, check.NotNil)
+	transport := client.HTTPClient.Transport.(*http.Transport)
+	c.Assert(transport.TLSClientConfig, check.Equals, client.TLSConfig)
+}
+
+func (s *S) TestAgentInitDockerAPIVersion(c *check.C) {
+	a := Agent{
+		DockerAddress:    "localhost:2375",
+		DockerAPIVersion: "x",
+		FusisAddress:     "10.0.0.1",
+		LabelFilter:      "router=fusis",
+		Interval:         time.Second,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, `invalid docker API version: (?i)unable to parse version "x"`)
+	a.DockerAPIVersion = "1.21"
+	err = a.Init()
+	c.Assert(err, check.ErrorMatches, `docker API version 1.21 is not supported, minimum version is 1.22`)
+	a.DockerAPIVersion = "1.23"
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestCheckDockerAPIVersion(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	a := Agent{
+		DockerAddress: srv.URL(),
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	src := a.source.(*dockerSource)
+	err = src.checkAPIVersion()
+	c.Assert(err, check.IsNil)
+	c.Assert(src.serverVersion.String(), check.Equals, "1.22")
+	srv.CustomHandler("/v1.24/version", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "client is newer than server (client API version: 1.24, server API version: 1.22)", http.StatusBadRequest)
+	}))
+	a.DockerAPIVersion = "1.24"
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	err = a.source.(*dockerSource).checkAPIVersion()
+	c.Assert(err, check.ErrorMatches, `(?s)unable to use docker API version 1.24: .*client is newer than server.*`)
+	srv.CustomHandler("^/version", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Version":"1.8.3","ApiVersion":"1.20"}`))
+	}))
+	a.DockerAPIVersion = ""
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	err = a.source.(*dockerSource).checkAPIVersion()
+	c.Assert(err, check.ErrorMatches, "docker daemon API version 1.20 is too old, minimum version is 1.22")
+	a.Start()
+	a.Stop()
+	a.Wait()
+	c.Assert(s.executor.log, check.IsNil)
+}
+
+func (s *S) TestDockerSourceList(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	a := Agent{
+		DockerAddress: srv.URL(),
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	workloads, err := a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.IsNil)
+	cli, err := docker.NewClient(srv.URL())
+	c.Assert(err, check.IsNil)
+	err = cli.PullImage(docker.PullImageOptions{Repository: "base"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	cont, err := cli.CreateContainer(docker.CreateContainerOptions{
+		Name:       "mycont",
+		Config:     &docker.Config{Image: "base", Labels: map[string]string{"router": "fusis"}},
+		HostConfig: &docker.HostConfig{},
+	})
+	c.Assert(err, check.IsNil)
+	err = cli.StartContainer(cont.ID, nil)
+	c.Assert(err, check.IsNil)
+	cont, err = cli.InspectContainer(cont.ID)
+	c.Assert(err, check.IsNil)
+	workloads, err = a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.HasLen, 1)
+	c.Assert(workloads[0].ID, check.Equals, cont.ID)
+	c.Assert(workloads[0].Name, check.Equals, "mycont")
+	c.Assert(workloads[0].IPs, check.DeepEquals, []string{cont.NetworkSettings.IPAddress})
+}
+
+func (s *S) TestDockerSourceListSwarm(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	var filters string
+	// Services can't be listed on workers, where task containers are matched
+	// by their own labels. Task web.1 is being replaced by web.1 (new task id)
+	// in a rolling update, both are running until the old one dies.
+	srv.CustomHandler("/services", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "This node is not a swarm manager.", http.StatusServiceUnavailable)
+	}))
+	srv.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = r.URL.Query().Get("filters")
+		w.Write([]byte(`[
+  {"Id": "c1", "Names": ["/web.1.old"], "Labels": {"router": "fusis", "com.docker.swarm.task.id": "old", "com.docker.swarm.task.name": "web.1.old"},
+   "NetworkSettings": {"Networks": {"ingress": {"IPAddress": "10.255.0.5"}, "backend": {"IPAddress": "10.0.1.5"}}}},
+  {"Id": "c2", "Names": ["/web.1.new"], "Labels": {"router": "fusis", "com.docker.swarm.task.id": "new", "com.docker.swarm.task.name": "web.1.new"},
+   "NetworkSettings": {"Networks": {"ingress": {"IPAddress": "10.255.0.6"}, "backend": {"IPAddress": "10.0.1.6"}}}},
+  {"Id": "c3", "Names": ["/other"], "Labels": {"router": "fusis", "com.docker.swarm.task.id": "other"},
+   "NetworkSettings": {"Networks": {"ingress": {"IPAddress": "10.255.0.7"}}}}
+]`))
+	}))
+	srv.CustomHandler("/containers/c3/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id": "c3", "NetworkSettings": {"Networks": {"ingress": {"IPAddress": "10.255.0.7"}}}}`))
+	}))
+	a := Agent{
+		Runtime:       RuntimeSwarm,
+		DockerAddress: srv.URL(),
+		SwarmNetwork:  "backend",
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	workloads, err := a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(filters, check.Equals, `{"label":["router=fusis","com.docker.swarm.task.id"]}`)
+	c.Assert(workloads, check.HasLen, 2)
+	c.Assert(workloads[0].ID, check.Equals, "c1")
+	c.Assert(workloads[0].Name, check.Equals, "web.1.old")
+	c.Assert(workloads[0].IPs, check.DeepEquals, []string{"10.0.1.5"})
+	c.Assert(workloads[1].ID, check.Equals, "c2")
+	c.Assert(workloads[1].Name, check.Equals, "web.1.new")
+	c.Assert(workloads[1].IPs, check.DeepEquals, []string{"10.0.1.6"})
+	c.Assert(workloads[1].Network, check.Equals, "backend")
+}
+
+func (s *S) TestDockerSourceListSwarmServices(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	var serviceFilters, filters string
+	srv.CustomHandler("/services", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serviceFilters = r.URL.Query().Get("filters")
+		w.Write([]byte(`[{"ID": "s1", "Spec": {"Name": "web", "Labels": {"router": "fusis"}}}]`))
+	}))
+	srv.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = r.URL.Query().Get("filters")
+		w.Write([]byte(`[
+  {"Id": "c1", "Names": ["/web.1.abc"], "Labels": {"com.docker.swarm.service.id": "s1", "com.docker.swarm.task.name": "web.1.abc"},
+   "NetworkSettings": {"Networks": {"backend": {"IPAddress": "10.0.1.5"}}}},
+  {"Id": "c2", "Names": ["/db.1.def"], "Labels": {"router": "fusis", "com.docker.swarm.service.id": "s2", "com.docker.swarm.task.name": "db.1.def"},
+   "NetworkSettings": {"Networks": {"backend": {"IPAddress": "10.0.1.6"}}}}
+]`))
+	}))
+	a := Agent{
+		Runtime:       RuntimeSwarm,
+		DockerAddress: srv.URL(),
+		SwarmNetwork:  "backend",
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	workloads, err := a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(serviceFilters, check.Equals, `{"label":["router=fusis"]}`)
+	c.Assert(filters, check.Equals, `{"label":["com.docker.swarm.service.id"]}`)
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{
+			ID:      "c1",
+			Name:    "web.1.abc",
+			Labels:  map[string]string{"router": "fusis", "com.docker.swarm.service.id": "s1", "com.docker.swarm.task.name": "web.1.abc"},
+			IPs:     []string{"10.0.1.5"},
+			Network: "backend",
+		},
+	})
+	srv.CustomHandler("/services", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "this node is not a swarm manager", http.StatusInternalServerError)
+	}))
+	_, err = a.source.List(context.Background())
+	c.Assert(err, check.ErrorMatches, `error listing services: unexpected status 500: this node is not a swarm manager`)
+}
+
+func (s *S) TestAgentInitSwarm(c *check.C) {
+	a := Agent{
+		Runtime:      RuntimeSwarm,
+		FusisAddress: "192.168.1.1",
+		LabelFilter:  "router=fusis",
+		Interval:     time.Minute,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, "swarm network is mandatory")
+}
+
+func (s *S) TestDockerSourceWatch(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	requests := make(chan *http.Request, 1)
+	srv.CustomHandler("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"Type":"container","Action":"create","time":1}` + "\n"))
+		w.Write([]byte(`{"Type":"container","Action":"start","time":2}` + "\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	a := Agent{
+		DockerAddress: srv.URL(),
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	changes := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- a.source.Watch(changes, stop)
+	}()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for change notification")
+	}
+	r := <-requests
+	c.Assert(r.URL.Query().Get("filters"), check.Equals, `{"type":["container","network"]}`)
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
+
+func (s *S) TestDockerSourceListInspectCache(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	srv.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+  {"Id": "c1", "Names": ["/c1"], "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}},
+  {"Id": "c2", "Names": ["/c2"], "NetworkSettings": {"Networks": {"other": {}}}},
+  {"Id": "c3", "Names": ["/c3"], "NetworkSettings": {"Networks": {"other": {}}}}
+]`))
+	}))
+	var mu sync.Mutex
+	inspected := map[string]int{}
+	for id, ip := range map[string]string{"c2": "172.17.0.3", "c3": "172.17.0.4"} {
+		id, ip := id, ip
+		srv.CustomHandler("/containers/"+id+"/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inspected[id]++
+			mu.Unlock()
+			w.Write([]byte(`{"Id": "` + id + `", "NetworkSettings": {"IPAddress": "` + ip + `"}}`))
+		}))
+	}
+	a := Agent{
+		DockerAddress: srv.URL(),
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 2; i++ {
+		workloads, err := a.source.List(context.Background())
+		c.Assert(err, check.IsNil)
+		c.Assert(workloads, check.HasLen, 3)
+		c.Assert(workloads[1].IPs, check.DeepEquals, []string{"172.17.0.3"})
+		c.Assert(workloads[2].IPs, check.DeepEquals, []string{"172.17.0.4"})
+	}
+	c.Assert(inspected, check.DeepEquals, map[string]int{"c2": 1, "c3": 1})
+	source := a.source.(*dockerSource)
+	source.invalidate(eventContainerID(&docker.APIEvents{
+		Type:  "network",
+		Actor: docker.APIActor{ID: "net1", Attributes: map[string]string{"container": "c3"}},
+	}))
+	_, err = a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(inspected, check.DeepEquals, map[string]int{"c2": 1, "c3": 2})
+	source.invalidate("")
+	_, err = a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(inspected, check.DeepEquals, map[string]int{"c2": 2, "c3": 3})
+}
+
+func (s *S) TestEventContainerID(c *check.C) {
+	c.Assert(eventContainerID(&docker.APIEvents{Type: "container", Actor: docker.APIActor{ID: "c1"}}), check.Equals, "c1")
+	c.Assert(eventContainerID(&docker.APIEvents{Status: "die", ID: "c2"}), check.Equals, "c2")
+	c.Assert(eventContainerID(&docker.APIEvents{
+		Type:  "network",
+		Actor: docker.APIActor{ID: "net1", Attributes: map[string]string{"container": "c3"}},
+	}), check.Equals, "c3")
+}
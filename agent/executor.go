@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ExecutorAuto   = "auto"
+	ExecutorDirect = "direct"
+	ExecutorSudo   = "sudo"
+)
+
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+var (
+	// pkgExecutor is used when no executor is given, running commands using
+	// sudo. Tests replace it so no command ever runs.
+	pkgExecutor Executor = SudoExecutor{}
+
+	// commandTimeout limits how long any single command may run, a hung
+	// command must never block the agent.
+	commandTimeout = 30 * time.Second
+
+	procStatusFile = "/proc/self/status"
+
+	// newExecutor is replaced in tests, where no command must ever run.
+	newExecutor = NewExecutor
+)
+
+// Executor runs the commands used to configure the host, returning their
+// combined output. Commands must be canceled when ctx is done.
+type Executor interface {
+	Exec(ctx context.Context, cmd string, args ...string) ([]byte, error)
+}
+
+// DirectExecutor runs commands as the agent user, which must be root or have
+// the CAP_NET_ADMIN and CAP_NET_RAW capabilities.
+type DirectExecutor struct{}
+
+func (e DirectExecutor) Exec(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	return runCommand(ctx, cmd, args...)
+}
+
+// SudoExecutor runs commands using sudo, which must not ask for a password.
+type SudoExecutor struct{}
+
+func (e SudoExecutor) Exec(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	return runCommand(ctx, "sudo", append([]string{cmd}, args...)...)
+}
+
+// NetnsExecutor runs commands inside the network namespace at Path, such as
+// /proc/1/ns/net or a namespace created by ip netns, using Executor to run
+// nsenter.
+type NetnsExecutor struct {
+	Executor Executor
+	Path     string
+}
+
+func (e NetnsExecutor) Exec(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	return e.Executor.Exec(ctx, "nsenter", append([]string{"--net=" + e.Path, "--", cmd}, args...)...)
+}
+
+func runCommand(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	fullCmd := append([]string{cmd}, args...)
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, cmd, args...).CombinedOutput()
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			err = fmt.Errorf("timed out after %s", commandTimeout)
+		case context.Canceled:
+			err = ctx.Err()
+		}
+		err = fmt.Errorf("error running command %q: %s - output: %q", strings.Join(fullCmd, " "), err, string(out))
+	}
+	return out, err
+}
+
+// NewExecutor returns the executor for the given mode, ensuring it's able to
+// run the given commands. In auto mode commands are run directly if possible,
+// falling back to sudo.
+func NewExecutor(mode string, commands []string) (Executor, error) {
+	switch mode {
+	case "", ExecutorAuto:
+		if hasNetCapabilities() {
+			return NewExecutor(ExecutorDirect, commands)
+		}
+		if _, err := exec.LookPath("sudo"); err != nil {
+			return nil, errors.New("agent must run as root or with CAP_NET_ADMIN and CAP_NET_RAW capabilities, or have sudo available")
+		}
+		return NewExecutor(ExecutorSudo, commands)
+	case ExecutorDirect:
+		if !hasNetCapabilities() {
+			return nil, errors.New("agent must run as root or with CAP_NET_ADMIN and CAP_NET_RAW capabilities to run commands directly")
+		}
+		for _, cmd := range commands {
+			if _, err := exec.LookPath(cmd); err != nil {
+				return nil, fmt.Errorf("required command %q not found: %s", cmd, err)
+			}
+		}
+		return DirectExecutor{}, nil
+	case ExecutorSudo:
+		if _, err := exec.LookPath("sudo"); err != nil {
+			return nil, fmt.Errorf("sudo not found: %s", err)
+		}
+		// Commands are looked up by sudo using its own secure path, each one
+		// is checked by asking sudo, without a password, if it may be run.
+		for _, cmd := range commands {
+			_, err := runCommand(context.Background(), "sudo", "-n", "-l", cmd)
+			if err != nil {
+				return nil, fmt.Errorf("required command %q not available using sudo without password: %s", cmd, err)
+			}
+		}
+		return SudoExecutor{}, nil
+	}
+	return nil, fmt.Errorf("unknown executor %q", mode)
+}
+
+// hasNetCapabilities returns whether the process has the effective
+// capabilities required to change routes and iptables rules.
+func hasNetCapabilities() bool {
+	data, err := ioutil.ReadFile(procStatusFile)
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	caps, err := parseCapEff(data)
+	if err != nil {
+		return os.Geteuid() == 0
+	}
+	required := uint64(1)<<capNetAdmin | uint64(1)<<capNetRaw
+	return caps&required == required
+}
+
+// parseCapEff returns the effective capabilities set from the contents of a
+// /proc/<pid>/status file.
+func parseCapEff(status []byte) (uint64, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "CapEff:" {
+			return strconv.ParseUint(fields[1], 16, 64)
+		}
+	}
+	return 0, errors.New("effective capabilities not found")
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseCapEff(c *check.C) {
+	caps, err := parseCapEff([]byte("Name:\tfusis-agent\nCapInh:\t0000000000000000\nCapPrm:\t0000000000003000\nCapEff:\t0000000000003000\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(caps, check.Equals, uint64(1<<capNetAdmin|1<<capNetRaw))
+	_, err = parseCapEff([]byte("Name:\tfusis-agent\n"))
+	c.Assert(err, check.ErrorMatches, "effective capabilities not found")
+}
+
+func (s *S) TestCheckExecutor(c *check.C) {
+	oldStatusFile := procStatusFile
+	defer func() { procStatusFile = oldStatusFile }()
+	f, err := ioutil.TempFile("", "status")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.Close()
+	procStatusFile = f.Name()
+	err = ioutil.WriteFile(procStatusFile, []byte("CapEff:\t0000000000001000\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = NewExecutor(ExecutorDirect, []string{"sh"})
+	c.Assert(err, check.ErrorMatches, "agent must run as root or with CAP_NET_ADMIN and CAP_NET_RAW capabilities to run commands directly")
+	err = ioutil.WriteFile(procStatusFile, []byte("CapEff:\t0000003fffffffff\n"), 0644)
+	c.Assert(err, check.IsNil)
+	exec, err := NewExecutor(ExecutorAuto, []string{"sh"})
+	c.Assert(err, check.IsNil)
+	c.Assert(exec, check.Equals, DirectExecutor{})
+	_, err = NewExecutor(ExecutorDirect, []string{"sh", "fusis-nonexistent-command"})
+	c.Assert(err, check.ErrorMatches, `required command "fusis-nonexistent-command" not found: .*`)
+	_, err = NewExecutor("ssh", nil)
+	c.Assert(err, check.ErrorMatches, `unknown executor "ssh"`)
+}
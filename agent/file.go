@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// fileSource reads backends from a file, for workloads which are not
+// containers such as VMs bridged onto the host. The file has either one IP
+// per line, with # starting comments, or a JSON array of objects:
+//
+//	[{"ip": "10.0.0.5", "id": "vm-1", "name": "web", "labels": {"app": "web"}}]
+type fileSource struct {
+	path string
+}
+
+var _ ContainerSource = &fileSource{}
+
+type fileBackend struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	IP     string            `json:"ip"`
+	Labels map[string]string `json:"labels"`
+}
+
+func (s *fileSource) List(ctx context.Context) ([]Workload, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var backends []fileBackend
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		err = json.Unmarshal(trimmed, &backends)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing backends file %q: %s", s.path, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if idx := strings.Index(line, "#"); idx != -1 {
+				line = line[:idx]
+			}
+			line = strings.TrimSpace(line)
+			if line != "" {
+				backends = append(backends, fileBackend{IP: line})
+			}
+		}
+	}
+	workloads := make([]Workload, 0, len(backends))
+	for i, b := range backends {
+		ip := net.ParseIP(b.IP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q in backends file %q, entry %d", b.IP, s.path, i+1)
+		}
+		id := b.ID
+		if id == "" {
+			id = ip.String()
+		}
+		workloads = append(workloads, Workload{
+			ID:     id,
+			Name:   b.Name,
+			Labels: b.Labels,
+			IPs:    []string{ip.String()},
+		})
+	}
+	return workloads, nil
+}
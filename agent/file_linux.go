@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const fileWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// Watch uses inotify on the parent directory, so files replaced by renaming
+// a new version over them, as most editors do, are also detected.
+func (s *fileSource) Watch(changes chan<- struct{}, stop <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// Reads are made through a pollFile, so Close interrupts a pending one.
+	file, err := newPollFile(fd)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = syscall.InotifyAddWatch(fd, filepath.Dir(s.path), fileWatchMask)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			file.Close()
+		case <-done:
+		}
+	}()
+	name := filepath.Base(s.path)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			return err
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(ev.Len)
+			evName := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+			if evName == name {
+				notifyChange(changes)
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"os"
+	"time"
+)
+
+// fileWatchInterval is how often the file modification time is checked on
+// platforms without inotify.
+var fileWatchInterval = 5 * time.Second
+
+func (s *fileSource) Watch(changes chan<- struct{}, stop <-chan struct{}) error {
+	var last time.Time
+	if info, err := os.Stat(s.path); err == nil {
+		last = info.ModTime()
+	}
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(fileWatchInterval):
+		}
+		var current time.Time
+		if info, err := os.Stat(s.path); err == nil {
+			current = info.ModTime()
+		}
+		if !current.Equal(last) {
+			notifyChange(changes)
+		}
+		last = current
+	}
+}
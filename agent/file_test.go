@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestFileSourceListLines(c *check.C) {
+	dir, err := ioutil.TempDir("", "backends")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends")
+	src := fileSource{path: path}
+	workloads, err := src.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.IsNil)
+	err = ioutil.WriteFile(path, []byte("# vms\n10.0.0.5\n\n  10.0.0.6 # bridged\n"), 0644)
+	c.Assert(err, check.IsNil)
+	workloads, err = src.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{ID: "10.0.0.5", IPs: []string{"10.0.0.5"}},
+		{ID: "10.0.0.6", IPs: []string{"10.0.0.6"}},
+	})
+	err = ioutil.WriteFile(path, []byte("10.0.0.5\nmyhost\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = src.List(context.Background())
+	c.Assert(err, check.ErrorMatches, `invalid IPv4 address "myhost" in backends file ".*", entry 2`)
+}
+
+func (s *S) TestFileSourceListJSON(c *check.C) {
+	f, err := ioutil.TempFile("", "backends")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte(`[
+		{"ip": "10.0.0.5", "id": "vm-1", "name": "web", "labels": {"app": "web"}},
+		{"ip": "10.0.0.6"}
+	]`))
+	c.Assert(err, check.IsNil)
+	f.Close()
+	src := fileSource{path: f.Name()}
+	workloads, err := src.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{ID: "vm-1", Name: "web", Labels: map[string]string{"app": "web"}, IPs: []string{"10.0.0.5"}},
+		{ID: "10.0.0.6", IPs: []string{"10.0.0.6"}},
+	})
+	err = ioutil.WriteFile(f.Name(), []byte(`[{"ip": 10}]`), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = src.List(context.Background())
+	c.Assert(err, check.ErrorMatches, `error parsing backends file ".*": json: cannot unmarshal number .*`)
+}
+
+func (s *S) TestFileSourceWatch(c *check.C) {
+	dir, err := ioutil.TempDir("", "backends")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backends")
+	src := fileSource{path: path}
+	changes := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- src.Watch(changes, stop)
+	}()
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		err = ioutil.WriteFile(filepath.Join(dir, "other"), []byte("10.0.0.1\n"), 0644)
+		c.Assert(err, check.IsNil)
+		err = ioutil.WriteFile(path, []byte("10.0.0.1\n"), 0644)
+		c.Assert(err, check.IsNil)
+		select {
+		case <-changes:
+			done = true
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			c.Fatal("timeout waiting for change notification")
+		}
+	}
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
+
+func (s *S) TestAgentInitBackendsFile(c *check.C) {
+	a := Agent{
+		Runtime:      RuntimeNone,
+		FusisAddress: "10.0.0.1",
+		LabelFilter:  "router=fusis",
+		Interval:     time.Second,
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, "backends file is mandatory when no container runtime is used")
+	a.BackendsFile = "/etc/fusis/backends"
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	c.Assert(a.source, check.DeepEquals, &fileSource{path: "/etc/fusis/backends"})
+	a.Runtime = RuntimeContainerd
+	a.ContainerdAddress = "/run/containerd/containerd.sock"
+	a.ContainerdNamespace = "default"
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	c.Assert(a.source, check.DeepEquals, multiSource{
+		&containerdSource{
+			address:     "/run/containerd/containerd.sock",
+			namespace:   "default",
+			labelFilter: "router=fusis",
+			executor:    s.executor,
+		},
+		&fileSource{path: "/etc/fusis/backends"},
+	})
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Treatments of workloads without healthcheck, in Agent.WithoutHealthcheck,
+// when only healthy workloads are included.
+const (
+	HealthcheckInclude = "include"
+	HealthcheckExclude = "exclude"
+)
+
+// Health statuses reported by sources in Workload.Health.
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// containerHealth returns the health status in the status of a listed docker
+// container, as in "Up 5 minutes (health: starting)", empty if it has no
+// healthcheck. The human-readable status is the only place listed containers
+// carry their health with the vendored go-dockerclient, which lacks
+// State.Health, so a daemon changing its format makes every container look
+// as having no healthcheck.
+func containerHealth(status string) string {
+	switch {
+	case strings.HasSuffix(status, "(health: starting)"):
+		return healthStarting
+	case strings.HasSuffix(status, "(unhealthy)"):
+		return healthUnhealthy
+	case strings.HasSuffix(status, "(healthy)"):
+		return healthHealthy
+	}
+	return ""
+}
+
+// filterHealthy returns the workloads which may receive traffic when only
+// healthy ones are included, along with a description of the excluded ones.
+func (a *Agent) filterHealthy(workloads []Workload) ([]Workload, []string) {
+	if !a.HealthyOnly {
+		return workloads, nil
+	}
+	var included []Workload
+	var excluded []string
+	for _, w := range workloads {
+		health := w.Health
+		if health == "" {
+			if a.WithoutHealthcheck != HealthcheckExclude {
+				included = append(included, w)
+				continue
+			}
+			health = "no healthcheck"
+		}
+		if health == healthHealthy {
+			included = append(included, w)
+			continue
+		}
+		name := w.Name
+		if name == "" {
+			name = w.ID
+		}
+		excluded = append(excluded, fmt.Sprintf("%s: %s", name, health))
+	}
+	return included, excluded
+}
+
+// setStatusExcluded updates the workloads excluded in the status, logging
+// the ones not excluded before.
+func (a *Agent) setStatusExcluded(excluded []string) {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	known := make(map[string]bool)
+	for _, e := range a.status.Excluded {
+		known[e] = true
+	}
+	for _, e := range excluded {
+		if !known[e] {
+			log.Printf("excluding workload %s", e)
+		}
+	}
+	a.status.Excluded = excluded
+}
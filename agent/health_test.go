@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	dockerTesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestContainerHealth(c *check.C) {
+	c.Assert(containerHealth("Up 5 minutes"), check.Equals, "")
+	c.Assert(containerHealth("Up 5 seconds (health: starting)"), check.Equals, "starting")
+	c.Assert(containerHealth("Up 5 minutes (healthy)"), check.Equals, "healthy")
+	c.Assert(containerHealth("Up 5 minutes (unhealthy)"), check.Equals, "unhealthy")
+}
+
+func (s *S) TestAgentReconcileHealthyOnly(c *check.C) {
+	source := &fakeSource{workloads: []Workload{
+		{ID: "c1", Name: "web-1", IPs: []string{"10.0.0.1"}, Health: "healthy"},
+		{ID: "c2", Name: "web-2", IPs: []string{"10.0.0.2"}, Health: "starting"},
+		{ID: "c3", Name: "web-3", IPs: []string{"10.0.0.3"}, Health: "unhealthy"},
+		{ID: "c4", IPs: []string{"10.0.0.4"}},
+	}}
+	applier := &fakeApplier{}
+	a, err := New(source, applier, Options{Router: "192.168.1.1", Interval: time.Minute})
+	c.Assert(err, check.IsNil)
+	err = a.reconcile(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(applier.applied, check.HasLen, 4)
+	c.Assert(a.Status().Excluded, check.IsNil)
+	a.HealthyOnly = true
+	err = a.reconcile(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(applier.applied, check.DeepEquals, []Backend{
+		{IP: "10.0.0.1", ContainerID: "c1", Name: "web-1", Router: "192.168.1.1"},
+		{IP: "10.0.0.4", ContainerID: "c4", Router: "192.168.1.1"},
+	})
+	c.Assert(a.Status().Excluded, check.DeepEquals, []string{"web-2: starting", "web-3: unhealthy"})
+	a.WithoutHealthcheck = HealthcheckExclude
+	err = a.reconcile(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(applier.applied, check.DeepEquals, []Backend{
+		{IP: "10.0.0.1", ContainerID: "c1", Name: "web-1", Router: "192.168.1.1"},
+	})
+	c.Assert(a.Status().Excluded, check.DeepEquals, []string{"web-2: starting", "web-3: unhealthy", "c4: no healthcheck"})
+}
+
+func (s *S) TestAgentInitWithoutHealthcheck(c *check.C) {
+	a := Agent{
+		FusisAddress:       "192.168.1.1",
+		LabelFilter:        "router=fusis",
+		Interval:           time.Minute,
+		WithoutHealthcheck: "ignore",
+	}
+	err := a.Init()
+	c.Assert(err, check.ErrorMatches, `unknown treatment "ignore" for workloads without healthcheck`)
+}
+
+func (s *S) TestDockerSourceHealth(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	srv.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+  {"Id": "c1", "Names": ["/c1"], "Status": "Up 1 minute (healthy)", "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}},
+  {"Id": "c2", "Names": ["/c2"], "Status": "Up 1 minute", "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.3"}}}}
+]`))
+	}))
+	srv.CustomHandler("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"Type":"container","Action":"exec_start: true","time":1}` + "\n"))
+		w.Write([]byte(`{"Type":"container","Action":"health_status: unhealthy","time":2}` + "\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	a := Agent{
+		DockerAddress: srv.URL(),
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	workloads, err := a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.HasLen, 2)
+	c.Assert(workloads[0].Health, check.Equals, "healthy")
+	c.Assert(workloads[1].Health, check.Equals, "")
+	changes := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- a.source.Watch(changes, stop)
+	}()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for change notification")
+	}
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
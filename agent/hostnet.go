@@ -0,0 +1,50 @@
+package agent
+
+import "fmt"
+
+// Workloads using the host network share its address, their responses are
+// identified by source port or cgroup instead. As they're generated locally,
+// they're marked by a chain in OUTPUT, rerouting them through the router
+// table. The cgroup of a packet is only known in the network namespace of
+// its socket, so workloads with their own namespace can't be matched by
+// cgroup.
+
+func outputChain(chain string) string {
+	return chain + "_OUTPUT"
+}
+
+func (a *NATApplier) outputChain() string {
+	return outputChain(a.opts.Chain)
+}
+
+// splitBackends separates the backends marked by address from the ones
+// using the host network, marked by source port or cgroup.
+func splitBackends(backends []Backend) ([]Backend, []Backend) {
+	var ipBackends, portBackends []Backend
+	for _, b := range backends {
+		if b.IP == "" {
+			portBackends = append(portBackends, b)
+		} else {
+			ipBackends = append(ipBackends, b)
+		}
+	}
+	return ipBackends, portBackends
+}
+
+// verifyOutputChain describes the differences between the chain marking
+// responses from backends using the host network and the one expected.
+func (a *NATApplier) verifyOutputChain(current *iptablesTable, backends []Backend) []string {
+	name := a.outputChain()
+	chain := current.Chain(name)
+	if chain == nil {
+		if len(backends) == 0 {
+			return nil
+		}
+		return []string{fmt.Sprintf("chain %s missing", name)}
+	}
+	var drift []string
+	if jumps := countJumps(current.Chain("OUTPUT"), name); jumps != 1 {
+		drift = append(drift, fmt.Sprintf("%d jumps to chain %s in OUTPUT", jumps, name))
+	}
+	return append(drift, a.verifyRules(chain, backends)...)
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	dockerTesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParsePorts(c *check.C) {
+	ports, err := parsePorts("80, 53/UDP,,443/tcp")
+	c.Assert(err, check.IsNil)
+	c.Assert(ports, check.DeepEquals, []string{"80/tcp", "53/udp", "443/tcp"})
+	for _, value := range []string{"http", "0", "65536", "80/sctp"} {
+		_, err = parsePorts(value)
+		c.Assert(err, check.ErrorMatches, `invalid port ".*"`)
+	}
+}
+
+func (s *S) TestApplyHostPorts(c *check.C) {
+	nat := newTestNAT(c)
+	backends := append(testBackends("10.0.0.1"),
+		Backend{Port: "80/tcp", ContainerID: "c1"},
+		Backend{Port: "53/udp"},
+	)
+	err := nat.Apply(context.Background(), backends)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-N", "FUSIS_OUTPUT"},
+		{"iptables", "-t", "mangle", "-w", "5", "-I", "OUTPUT", "-j", "FUSIS_OUTPUT"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS_OUTPUT", "-p", "udp", "-m", "udp", "--sport", "53", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS_OUTPUT", "-p", "tcp", "-m", "tcp", "--sport", "80", "-m", "comment", "--comment", "c1", "-j", "MARK", "--set-mark", "9"},
+	}...))
+	s.executor.log = nil
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:FUSIS - [0:0]
+:FUSIS_OUTPUT - [0:0]
+-A PREROUTING -j FUSIS
+-A OUTPUT -j FUSIS_OUTPUT
+-A FUSIS -s 10.0.0.1/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS_OUTPUT -p udp -m udp --sport 53 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS_OUTPUT -p tcp -m tcp --sport 80 -m comment --comment c1 -j MARK --set-xmark 0x9/0xffffffff
+COMMIT
+`)},
+	}
+	drift, err := nat.Verify(context.Background(), backends)
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.IsNil)
+	drift, err = nat.Verify(context.Background(), backends[:2])
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{"stale rule -p udp -m udp --sport 53 -j MARK --set-xmark 0x9/0xffffffff"})
+	// Rules for ports are removed along with the last backend using the
+	// host network, without flushing conntrack entries.
+	flushed := 0
+	defer func(orig func(context.Context, string, []string) (int, error)) { conntrackFlush = orig }(conntrackFlush)
+	conntrackFlush = func(ctx context.Context, netns string, ips []string) (int, error) {
+		flushed++
+		return 0, nil
+	}
+	nat.opts.FlushConntrack = true
+	err = nat.Apply(context.Background(), backends[:1])
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log[len(s.executor.log)-2:], check.DeepEquals, [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS_OUTPUT", "-p", "udp", "-m", "udp", "--sport", "53", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS_OUTPUT", "-p", "tcp", "-m", "tcp", "--sport", "80", "-m", "comment", "--comment", "c1", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+	})
+	c.Assert(flushed, check.Equals, 0)
+}
+
+func (s *S) TestApplyInvalidPort(c *check.C) {
+	nat := newTestNAT(c)
+	err := nat.Apply(context.Background(), []Backend{{Port: "80"}, {Port: "tcp/80"}, {Port: "53/udp"}})
+	c.Assert(err, check.ErrorMatches, `multiple errors: error adding rule for .*invalid port "80" \| error adding rule for .*invalid port "tcp/80"`)
+	c.Assert(s.executor.log[len(s.executor.log)-1], check.DeepEquals,
+		[]string{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS_OUTPUT", "-p", "udp", "-m", "udp", "--sport", "53", "-j", "MARK", "--set-mark", "9"})
+}
+
+func (s *S) TestCleanupOutputChain(c *check.C) {
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:OUTPUT ACCEPT [0:0]
+:OLD_OUTPUT - [0:0]
+-A OUTPUT -j OLD_OUTPUT
+COMMIT
+`)},
+	}
+	nat := newTestNAT(c)
+	err := nat.Cleanup(context.Background(), &State{Chain: "OLD"})
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, [][]string{
+		{"iptables-save", "-t", "mangle"},
+		{"iptables-save", "-t", "mangle"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "OUTPUT", "-j", "OLD_OUTPUT"},
+		{"iptables", "-t", "mangle", "-w", "5", "-F", "OLD_OUTPUT"},
+		{"iptables", "-t", "mangle", "-w", "5", "-X", "OLD_OUTPUT"},
+	})
+}
+
+func (s *S) TestDockerSourceListHostNetwork(c *check.C) {
+	srv, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	defer srv.Stop()
+	srv.CustomHandler("/containers/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+  {"Id": "c1", "Names": ["/c1"], "Labels": {"fusis.ports": "8080,53/udp"}, "NetworkSettings": {"Networks": {"host": {}}}},
+  {"Id": "c2", "Names": ["/c2"], "NetworkSettings": {"Networks": {"host": {}}}},
+  {"Id": "c3", "Names": ["/c3"], "Labels": {"fusis.ports": "http"}, "NetworkSettings": {"Networks": {"host": {}}}},
+  {"Id": "c4", "Names": ["/c4"], "NetworkSettings": {"Networks": {"host": {}}}}
+]`))
+	}))
+	srv.CustomHandler("/containers/c2/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id": "c2", "Config": {"ExposedPorts": {"9090/tcp": {}, "443/tcp": {}, "9000/sctp": {}}}, "NetworkSettings": {}}`))
+	}))
+	srv.CustomHandler("/containers/c4/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id": "c4", "Config": {}, "NetworkSettings": {}}`))
+	}))
+	a := Agent{
+		DockerAddress: srv.URL(),
+		FusisAddress:  "192.168.1.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Minute,
+	}
+	err = a.Init()
+	c.Assert(err, check.IsNil)
+	workloads, err := a.source.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{ID: "c1", Name: "c1", Labels: map[string]string{"fusis.ports": "8080,53/udp"}, Network: "host", HostPorts: []string{"8080/tcp", "53/udp"}},
+		{ID: "c2", Name: "c2", Network: "host", HostPorts: []string{"443/tcp", "9090/tcp"}},
+	})
+	state := a.desiredState(workloads)
+	c.Assert(state.Backends, check.DeepEquals, []Backend{
+		{Port: "443/tcp", ContainerID: "c2", Name: "c2", Network: "host", Router: "192.168.1.1"},
+		{Port: "53/udp", ContainerID: "c1", Name: "c1", Labels: map[string]string{"fusis.ports": "8080,53/udp"}, Network: "host", Router: "192.168.1.1"},
+		{Port: "8080/tcp", ContainerID: "c1", Name: "c1", Labels: map[string]string{"fusis.ports": "8080,53/udp"}, Network: "host", Router: "192.168.1.1"},
+		{Port: "9090/tcp", ContainerID: "c2", Name: "c2", Network: "host", Router: "192.168.1.1"},
+	})
+}
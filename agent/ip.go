@@ -1,70 +1,188 @@
 package agent
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	errRouteExists = errors.New("route already exists")
 	errChainExists = errors.New("chain already exists")
 	errNoSuchRule  = errors.New("no such rule")
+	// errNoSuchTunnel is returned when deleting a tunnel which doesn't exist.
+	errNoSuchTunnel = errors.New("no such tunnel")
 
 	reFileExists  = regexp.MustCompile(`(?i).*file exists.*`)
 	reChainExists = regexp.MustCompile(`(?i).*chain already exists.*`)
 	reNoRule      = regexp.MustCompile(`(?i).*no .* by that name.*`)
+	reNoSuchFile  = regexp.MustCompile(`(?i).*no such (file|process).*`)
+	reNoSuchDev   = regexp.MustCompile(`(?i).*(no such device|cannot find device|does not exist).*`)
+	reXtablesLock = regexp.MustCompile(`(?i).*(another app is currently holding the xtables lock|resource temporarily unavailable).*`)
 )
 
 var (
-	pkgExecutor executor = sudoExecutor{}
+	// xtablesWait is how long iptables waits for the xtables lock, usually
+	// held by docker or kube-proxy, before failing.
+	xtablesWait = 5 * time.Second
+	// xtablesRetries is how many times iptables is run again after failing to
+	// acquire the xtables lock, waiting xtablesBackoff between attempts, which
+	// is doubled after each one.
+	xtablesRetries = 3
+	xtablesBackoff = 500 * time.Millisecond
 )
 
-type executor interface {
-	Exec(cmd string, args ...string) ([]byte, error)
+// executorOrDefault returns e, or the package executor if it's nil.
+func executorOrDefault(e Executor) Executor {
+	if e == nil {
+		return pkgExecutor
+	}
+	return e
+}
+
+type ipRule struct {
+	executor Executor
 }
 
-type sudoExecutor struct{}
+func (i *ipRule) List(ctx context.Context) ([]byte, error) {
+	return executorOrDefault(i.executor).Exec(ctx, "ip", "rule", "list")
+}
+
+// Add adds a rule looking up table for packets marked with fwmark, at the
+// given priority.
+func (i *ipRule) Add(ctx context.Context, priority int, fwmark string, table string) error {
+	_, err := executorOrDefault(i.executor).Exec(ctx, "ip", "rule", "add", "pref", strconv.Itoa(priority), "fwmark", fwmark, "table", table)
+	return err
+}
+
+func (i *ipRule) Del(ctx context.Context, fwmark string, table string) error {
+	out, err := executorOrDefault(i.executor).Exec(ctx, "ip", "rule", "del", "fwmark", fwmark, "table", table)
+	if err != nil && reNoSuchFile.Match(out) {
+		return errNoSuchRule
+	}
+	return err
+}
 
-func (e sudoExecutor) Exec(cmd string, args ...string) ([]byte, error) {
-	fullCmd := append([]string{cmd}, args...)
-	out, err := exec.Command("sudo", fullCmd...).CombinedOutput()
+// Rules returns the rules in the order they're evaluated.
+func (i *ipRule) Rules(ctx context.Context) ([]ipRuleEntry, error) {
+	out, err := i.List(ctx)
 	if err != nil {
-		err = fmt.Errorf("error running command %q: %s - output: %q", strings.Join(fullCmd, " "), err, string(out))
+		return nil, err
 	}
-	return out, err
+	return parseRules(out)
+}
+
+// DelEntry removes the rule matching exactly the given one.
+func (i *ipRule) DelEntry(ctx context.Context, r ipRuleEntry) error {
+	args := append([]string{"rule", "del", "pref", strconv.Itoa(r.Priority)}, r.Args...)
+	out, err := executorOrDefault(i.executor).Exec(ctx, "ip", args...)
+	if err != nil && reNoSuchFile.Match(out) {
+		return errNoSuchRule
+	}
+	return err
 }
 
-type ipRule struct{}
+// ipRuleEntry is a rule as shown by ip rule list, such as
+// "32765:	from all fwmark 0x9 lookup fusis.out".
+type ipRuleEntry struct {
+	Priority int
+	// Args are the selectors and action of the rule, as accepted by ip rule.
+	Args []string
+	// From is the source selector, Mark the fwmark one, with an optional
+	// mask, and Table the looked up table, empty if not set.
+	From  string
+	Mark  string
+	Table string
+	// Other is set when the rule has selectors or modifiers besides From
+	// and Mark.
+	Other bool
+}
 
-func (i *ipRule) List() ([]byte, error) {
-	return pkgExecutor.Exec("ip", "rule", "list")
+func (r ipRuleEntry) String() string {
+	return fmt.Sprintf("%d: %s", r.Priority, strings.Join(r.Args, " "))
 }
 
-func (i *ipRule) Add(fwmark string, table string) error {
-	_, err := pkgExecutor.Exec("ip", "rule", "add", "fwmark", fwmark, "table", table)
-	return err
+// MatchesMark returns whether packets with mark, and any source, are
+// matched by the rule.
+func (r ipRuleEntry) MatchesMark(mark uint32) bool {
+	if r.Other || (r.From != "" && r.From != "all") {
+		return false
+	}
+	if r.Mark == "" {
+		return true
+	}
+	value, mask, err := parseFwmark(r.Mark)
+	return err == nil && mark&mask == value
 }
 
-func (i *ipRule) AddIfNotExists(fwmark string, table string) error {
-	out, err := i.List()
+// parseFwmark parses a mark as shown by ip rule, with an optional mask.
+func parseFwmark(s string) (value uint32, mask uint32, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	v, err := strconv.ParseUint(parts[0], 0, 32)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-	if bytes.Contains(out, []byte("lookup "+table)) {
-		return nil
+	m := uint64(0xffffffff)
+	if len(parts) == 2 {
+		m, err = strconv.ParseUint(parts[1], 0, 32)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
-	return i.Add(fwmark, table)
+	return uint32(v), uint32(m), nil
 }
 
-type ipRoute struct{}
+func parseRules(out []byte) ([]ipRuleEntry, error) {
+	var rules []ipRuleEntry
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		priority, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil || !strings.HasSuffix(fields[0], ":") {
+			return nil, fmt.Errorf("unexpected ip rule output: %q", line)
+		}
+		r := ipRuleEntry{Priority: priority}
+		for i := 1; i < len(fields); i++ {
+			// Flags such as [detached] are not part of the rule.
+			if strings.HasPrefix(fields[i], "[") || fields[i] == "unresolved" {
+				continue
+			}
+			r.Args = append(r.Args, fields[i])
+			var value *string
+			switch fields[i] {
+			case "from":
+				value = &r.From
+			case "fwmark":
+				value = &r.Mark
+			case "lookup", "table":
+				value = &r.Table
+			default:
+				r.Other = true
+				continue
+			}
+			if i+1 < len(fields) {
+				i++
+				*value = fields[i]
+				r.Args = append(r.Args, fields[i])
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+type ipRoute struct {
+	executor Executor
+}
 
-func (i *ipRoute) AddDefault(gw string, table string) error {
-	out, err := pkgExecutor.Exec("ip", "route", "add", "default", "via", gw, "table", table)
+func (i *ipRoute) AddDefault(ctx context.Context, gw string, table string) error {
+	out, err := executorOrDefault(i.executor).Exec(ctx, "ip", "route", "add", "default", "via", gw, "table", table)
 	if err != nil {
 		if reFileExists.Match(out) {
 			return errRouteExists
@@ -74,12 +192,138 @@ func (i *ipRoute) AddDefault(gw string, table string) error {
 	return nil
 }
 
+func (i *ipRoute) DelDefault(ctx context.Context, gw string, table string) error {
+	out, err := executorOrDefault(i.executor).Exec(ctx, "ip", "route", "del", "default", "via", gw, "table", table)
+	if err != nil && reNoSuchFile.Match(out) {
+		return errNoSuchRule
+	}
+	return err
+}
+
+// ReplaceDefaultDev makes dev the default route in table, replacing any
+// previous default route.
+func (i *ipRoute) ReplaceDefaultDev(ctx context.Context, dev string, table string) error {
+	_, err := executorOrDefault(i.executor).Exec(ctx, "ip", "route", "replace", "default", "dev", dev, "table", table)
+	return err
+}
+
+func (i *ipRoute) Flush(ctx context.Context, table string) error {
+	_, err := executorOrDefault(i.executor).Exec(ctx, "ip", "route", "flush", "table", table)
+	return err
+}
+
+type ipTunnel struct {
+	executor Executor
+}
+
+// tunnelConfig describes a point-to-point tunnel as created by ip tunnel,
+// Local is empty if chosen by the kernel.
+type tunnelConfig struct {
+	Name   string
+	Mode   string
+	Remote string
+	Local  string
+}
+
+func (t tunnelConfig) String() string {
+	local := t.Local
+	if local == "" {
+		local = "any"
+	}
+	return fmt.Sprintf("%s mode %s remote %s local %s", t.Name, t.Mode, t.Remote, local)
+}
+
+// tunnelModes maps the modes shown by ip tunnel show to the ones used to
+// create tunnels.
+var tunnelModes = map[string]string{
+	"ip/ip":  "ipip",
+	"gre/ip": "gre",
+}
+
+// Show returns the configuration of the tunnel, nil if it doesn't exist.
+func (i *ipTunnel) Show(ctx context.Context, name string) (*tunnelConfig, error) {
+	out, err := executorOrDefault(i.executor).Exec(ctx, "ip", "tunnel", "show", name)
+	if err != nil {
+		if reNoSuchDev.Match(out) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseTunnel(name, out)
+}
+
+// parseTunnel parses the output of ip tunnel show for a single tunnel, such
+// as "fusis0: ip/ip remote 10.1.1.1 local any ttl 64".
+func parseTunnel(name string, out []byte) (*tunnelConfig, error) {
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 || fields[0] != name+":" {
+		return nil, fmt.Errorf("unexpected ip tunnel output: %q", string(out))
+	}
+	config := &tunnelConfig{Name: name, Mode: fields[1]}
+	if mode, ok := tunnelModes[fields[1]]; ok {
+		config.Mode = mode
+	}
+	for i := 2; i < len(fields)-1; i++ {
+		switch fields[i] {
+		case "remote":
+			config.Remote = fields[i+1]
+		case "local":
+			config.Local = fields[i+1]
+		}
+	}
+	if config.Remote == "any" {
+		config.Remote = ""
+	}
+	if config.Local == "any" {
+		config.Local = ""
+	}
+	return config, nil
+}
+
+func (i *ipTunnel) Add(ctx context.Context, t tunnelConfig) error {
+	args := []string{"tunnel", "add", t.Name, "mode", t.Mode, "remote", t.Remote}
+	if t.Local != "" {
+		args = append(args, "local", t.Local)
+	}
+	_, err := executorOrDefault(i.executor).Exec(ctx, "ip", append(args, "ttl", "64")...)
+	return err
+}
+
+func (i *ipTunnel) Del(ctx context.Context, name string) error {
+	out, err := executorOrDefault(i.executor).Exec(ctx, "ip", "tunnel", "del", name)
+	if err != nil && reNoSuchDev.Match(out) {
+		return errNoSuchTunnel
+	}
+	return err
+}
+
 type ipTables struct {
-	Table string
+	Table    string
+	executor Executor
+}
+
+// exec runs iptables waiting for the xtables lock, retrying with backoff if
+// it's still not acquired.
+func (i *ipTables) exec(ctx context.Context, rules ...string) ([]byte, error) {
+	wait := strconv.Itoa(int(xtablesWait / time.Second))
+	args := append([]string{"-t", i.Table, "-w", wait}, rules...)
+	backoff := xtablesBackoff
+	for attempt := 0; ; attempt++ {
+		out, err := executorOrDefault(i.executor).Exec(ctx, "iptables", args...)
+		if err == nil || attempt == xtablesRetries || !reXtablesLock.Match(out) {
+			return out, err
+		}
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
-func (i *ipTables) New(rules ...string) error {
-	out, err := pkgExecutor.Exec("iptables", append([]string{"-t", i.Table}, rules...)...)
+func (i *ipTables) New(ctx context.Context, rules ...string) error {
+	out, err := i.exec(ctx, rules...)
 	if err != nil {
 		if reChainExists.Match(out) {
 			return errChainExists
@@ -92,36 +336,58 @@ func (i *ipTables) New(rules ...string) error {
 	return nil
 }
 
-func (i *ipTables) NewIfNotExists(rules ...string) error {
+func (i *ipTables) NewIfNotExists(ctx context.Context, rules ...string) error {
 	rulesCheck := make([]string, len(rules))
 	copy(rulesCheck, rules)
 	rulesCheck[0] = "-C"
-	err := i.New(rulesCheck...)
+	err := i.New(ctx, rulesCheck...)
 	if err != nil {
 		if err == errNoSuchRule {
-			return i.New(rules...)
+			return i.New(ctx, rules...)
 		}
 		return err
 	}
 	return nil
 }
 
-func (i *ipTables) ListSource(chain string) ([]string, error) {
-	out, err := pkgExecutor.Exec("iptables-save", "-t", i.Table)
+// Save returns the current state of the table, as parsed from iptables-save.
+// If the table isn't loaded yet an empty table is returned.
+func (i *ipTables) Save(ctx context.Context) (*iptablesTable, error) {
+	out, err := executorOrDefault(i.executor).Exec(ctx, "iptables-save", "-t", i.Table)
 	if err != nil {
 		return nil, err
 	}
-	reSource, err := regexp.Compile(`^-A ` + chain + ` -s (.*?)/`)
+	state, err := parseIPTablesSave(out)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing iptables-save output: %s", err)
+	}
+	table := state.Table(i.Table)
+	if table == nil {
+		table = &iptablesTable{Name: i.Table}
+	}
+	return table, nil
+}
+
+// ListSource returns the source addresses of rules in chain, without the
+// prefix length of single addresses. Prefixes, as used by aggregated rules,
+// are expanded into their addresses unless shorter than maxExpandedPrefix.
+func (i *ipTables) ListSource(ctx context.Context, chain string) ([]string, error) {
+	table, err := i.Save(ctx)
 	if err != nil {
 		return nil, err
 	}
-	scanner := bufio.NewScanner(bytes.NewReader(out))
+	c := table.Chain(chain)
+	if c == nil {
+		return nil, nil
+	}
 	var ips []string
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		parts := reSource.FindSubmatch(line)
-		if len(parts) == 2 {
-			ips = append(ips, string(parts[1]))
+	for _, rule := range c.Rules {
+		if source, ok := rule.Arg("-s"); ok {
+			if addrs, ok := expandPrefix(source); ok {
+				ips = append(ips, addrs...)
+			} else {
+				ips = append(ips, source)
+			}
 		}
 	}
 	return ips, nil
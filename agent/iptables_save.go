@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// iptablesState is the parsed output of iptables-save, including counters
+// when it's run with -c.
+type iptablesState struct {
+	Tables []*iptablesTable
+}
+
+type iptablesTable struct {
+	Name   string
+	Chains []*iptablesChain
+}
+
+type iptablesChain struct {
+	Name string
+	// Policy is the default target of built-in chains, user defined chains
+	// have "-" as policy.
+	Policy   string
+	Counters iptablesCounters
+	Rules    []iptablesRule
+}
+
+type iptablesCounters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+type iptablesRule struct {
+	Counters iptablesCounters
+	// Args are the match and target arguments following "-A <chain>", as
+	// accepted by iptables -D to delete the rule.
+	Args []string
+}
+
+func (s *iptablesState) Table(name string) *iptablesTable {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *iptablesTable) Chain(name string) *iptablesChain {
+	if t == nil {
+		return nil
+	}
+	for _, c := range t.Chains {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Arg returns the value following flag in the rule arguments.
+func (r *iptablesRule) Arg(flag string) (string, bool) {
+	for i := 0; i < len(r.Args)-1; i++ {
+		if r.Args[i] == flag {
+			return r.Args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// Equal returns whether the rule has exactly the given arguments.
+func (r *iptablesRule) Equal(args ...string) bool {
+	if len(r.Args) != len(args) {
+		return false
+	}
+	for i := range args {
+		if r.Args[i] != args[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r iptablesRule) String() string {
+	quoted := make([]string, len(r.Args))
+	for i, arg := range r.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"") {
+			arg = `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseIPTablesSave parses the output of iptables-save. Tables must be
+// terminated by COMMIT and rules may only be appended to chains previously
+// declared in the same table.
+func parseIPTablesSave(data []byte) (*iptablesState, error) {
+	state := &iptablesState{}
+	var table *iptablesTable
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] != '*' && table == nil {
+			return nil, fmt.Errorf("line %d: %q outside of a table", lineNum, line)
+		}
+		switch {
+		case line[0] == '*':
+			if table != nil {
+				return nil, fmt.Errorf("line %d: table %q started before COMMIT of table %q", lineNum, line[1:], table.Name)
+			}
+			table = &iptablesTable{Name: line[1:]}
+		case line == "COMMIT":
+			state.Tables = append(state.Tables, table)
+			table = nil
+		case line[0] == ':':
+			chain, err := parseIPTablesChain(line[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNum, err)
+			}
+			table.Chains = append(table.Chains, chain)
+		default:
+			var rule iptablesRule
+			if line[0] == '[' {
+				end := strings.Index(line, "]")
+				if end == -1 {
+					return nil, fmt.Errorf("line %d: unterminated counters in %q", lineNum, line)
+				}
+				var err error
+				rule.Counters, err = parseIPTablesCounters(line[:end+1])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s", lineNum, err)
+				}
+				line = strings.TrimSpace(line[end+1:])
+			}
+			args, err := splitIPTablesArgs(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNum, err)
+			}
+			if len(args) < 2 || args[0] != "-A" {
+				return nil, fmt.Errorf("line %d: invalid rule %q", lineNum, line)
+			}
+			chain := table.Chain(args[1])
+			if chain == nil {
+				return nil, fmt.Errorf("line %d: rule for undeclared chain %q", lineNum, args[1])
+			}
+			rule.Args = args[2:]
+			chain.Rules = append(chain.Rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if table != nil {
+		return nil, fmt.Errorf("missing COMMIT for table %q", table.Name)
+	}
+	return state, nil
+}
+
+func parseIPTablesChain(line string) (*iptablesChain, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid chain %q", line)
+	}
+	chain := &iptablesChain{Name: fields[0], Policy: fields[1]}
+	if len(fields) == 3 {
+		var err error
+		chain.Counters, err = parseIPTablesCounters(fields[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chain, nil
+}
+
+// parseIPTablesCounters parses counters in the [packets:bytes] format.
+func parseIPTablesCounters(value string) (iptablesCounters, error) {
+	var counters iptablesCounters
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return counters, fmt.Errorf("invalid counters %q", value)
+	}
+	parts := strings.Split(value[1:len(value)-1], ":")
+	if len(parts) != 2 {
+		return counters, fmt.Errorf("invalid counters %q", value)
+	}
+	var err error
+	counters.Packets, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return counters, fmt.Errorf("invalid counters %q", value)
+	}
+	counters.Bytes, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return counters, fmt.Errorf("invalid counters %q", value)
+	}
+	return counters, nil
+}
+
+// splitIPTablesArgs splits a rule in its arguments, handling the double
+// quotes and escapes used by iptables-save in values such as comments.
+func splitIPTablesArgs(line string) ([]string, error) {
+	var args []string
+	var current []byte
+	inArg, inQuotes := false, false
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == '\\' && i+1 < len(line):
+			i++
+			current = append(current, line[i])
+			inArg = true
+		case ch == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (ch == ' ' || ch == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, string(current))
+				current = current[:0]
+				inArg = false
+			}
+		default:
+			current = append(current, ch)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if inArg {
+		args = append(args, string(current))
+	}
+	return args, nil
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseIPTablesSave(c *check.C) {
+	state, err := parseIPTablesSave([]byte(`# Generated by iptables-save v1.6.1 on Wed Jun 29 20:05:01 2016
+*nat
+:PREROUTING ACCEPT [12:720]
+:DOCKER - [0:0]
+[3:180] -A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
+COMMIT
+*mangle
+:PREROUTING ACCEPT [5796:531851]
+:FUSIS - [0:0]
+[5796:531851] -A PREROUTING -j FUSIS
+[10:600] -A FUSIS -s 10.0.0.1/32 -m comment --comment "web \"1\"" -j MARK --set-xmark 0x9/0xffffffff
+COMMIT
+# Completed on Wed Jun 29 20:05:01 2016
+`))
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Tables, check.HasLen, 2)
+	c.Assert(state.Table("filter"), check.IsNil)
+	nat := state.Table("nat")
+	c.Assert(nat.Chain("DOCKER"), check.DeepEquals, &iptablesChain{Name: "DOCKER", Policy: "-"})
+	mangle := state.Table("mangle")
+	c.Assert(mangle.Chain("PREROUTING"), check.DeepEquals, &iptablesChain{
+		Name:     "PREROUTING",
+		Policy:   "ACCEPT",
+		Counters: iptablesCounters{Packets: 5796, Bytes: 531851},
+		Rules: []iptablesRule{
+			{Counters: iptablesCounters{Packets: 5796, Bytes: 531851}, Args: []string{"-j", "FUSIS"}},
+		},
+	})
+	rules := mangle.Chain("FUSIS").Rules
+	c.Assert(rules, check.HasLen, 1)
+	c.Assert(rules[0].Args, check.DeepEquals, []string{
+		"-s", "10.0.0.1/32", "-m", "comment", "--comment", `web "1"`, "-j", "MARK", "--set-xmark", "0x9/0xffffffff",
+	})
+	c.Assert(rules[0].Counters, check.Equals, iptablesCounters{Packets: 10, Bytes: 600})
+	source, ok := rules[0].Arg("-s")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(source, check.Equals, "10.0.0.1/32")
+	_, ok = rules[0].Arg("-d")
+	c.Assert(ok, check.Equals, false)
+	c.Assert(rules[0].String(), check.Equals, `-s 10.0.0.1/32 -m comment --comment "web \"1\"" -j MARK --set-xmark 0x9/0xffffffff`)
+}
+
+func (s *S) TestParseIPTablesSaveErrors(c *check.C) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{":FUSIS - [0:0]\n", `line 1: ":FUSIS - \[0:0\]" outside of a table`},
+		{"*mangle\n*nat\n", `line 2: table "nat" started before COMMIT of table "mangle"`},
+		{"*mangle\n:FUSIS\n", `line 2: invalid chain "FUSIS"`},
+		{"*mangle\n:FUSIS - [0:x]\n", `line 2: invalid counters "\[0:x\]"`},
+		{"*mangle\n-A FUSIS -j ACCEPT\n", `line 2: rule for undeclared chain "FUSIS"`},
+		{"*mangle\n-I FUSIS -j ACCEPT\n", `line 2: invalid rule "-I FUSIS -j ACCEPT"`},
+		{"*mangle\n:FUSIS - [0:0]\n-A FUSIS -m comment --comment \"x\n", `line 3: unterminated quote in .*`},
+		{"*mangle\n:FUSIS - [0:0]\n", `missing COMMIT for table "mangle"`},
+	}
+	for _, tt := range tests {
+		_, err := parseIPTablesSave([]byte(tt.data))
+		c.Check(err, check.ErrorMatches, tt.err, check.Commentf("data: %q", tt.data))
+	}
+}
@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// errKubernetesGone is returned when the resource version watched is too old
+// to be available, requiring pods to be listed again.
+var errKubernetesGone = errors.New("resource version too old")
+
+// kubernetesSource lists pods scheduled on the local node directly from the
+// kubernetes API server.
+type kubernetesSource struct {
+	apiURL        string
+	tokenFile     string
+	nodeName      string
+	labelSelector string
+	client        *http.Client
+}
+
+var _ ContainerSource = &kubernetesSource{}
+
+type kubernetesPod struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		UID       string            `json:"uid"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName    string `json:"nodeName"`
+		HostNetwork bool   `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+type kubernetesPodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubernetesPod `json:"items"`
+}
+
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// newKubernetesSource creates a source using the API server at apiURL. When
+// apiURL is empty the in-cluster configuration, available to pods running in
+// a DaemonSet, is used.
+func newKubernetesSource(apiURL, tokenFile, caFile, nodeName, labelSelector string) (*kubernetesSource, error) {
+	if nodeName == "" {
+		return nil, errors.New("kubernetes node name is mandatory")
+	}
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("kubernetes API address is mandatory when running outside a cluster")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+		if tokenFile == "" {
+			tokenFile = kubernetesTokenFile
+		}
+		if caFile == "" {
+			caFile = kubernetesCAFile
+		}
+	}
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read kubernetes CA: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in kubernetes CA file %q", caFile)
+		}
+	}
+	return &kubernetesSource{
+		apiURL:        strings.TrimSuffix(apiURL, "/"),
+		tokenFile:     tokenFile,
+		nodeName:      nodeName,
+		labelSelector: labelSelector,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).Dial,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+	}, nil
+}
+
+func (s *kubernetesSource) List(ctx context.Context) ([]Workload, error) {
+	list, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var workloads []Workload
+	for _, pod := range list.Items {
+		// Pods in the host network share the node address, which must never
+		// be routed through fusis.
+		if pod.Status.Phase != "Running" || pod.Spec.HostNetwork {
+			continue
+		}
+		ips := podIPs(&pod)
+		if len(ips) == 0 {
+			continue
+		}
+		workloads = append(workloads, Workload{
+			ID:     pod.Metadata.UID,
+			Name:   pod.Metadata.Namespace + "/" + pod.Metadata.Name,
+			Labels: pod.Metadata.Labels,
+			IPs:    ips,
+		})
+	}
+	return workloads, nil
+}
+
+func (s *kubernetesSource) list(ctx context.Context) (*kubernetesPodList, error) {
+	rsp, err := s.get(ctx, "", false)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %s", err)
+	}
+	defer rsp.Body.Close()
+	var list kubernetesPodList
+	err = json.NewDecoder(rsp.Body).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding pod list: %s", err)
+	}
+	return &list, nil
+}
+
+// Watch watches pods starting from the resource version of a fresh list, so
+// no change is missed, listing them again whenever that version expires.
+func (s *kubernetesSource) Watch(changes chan<- struct{}, stop <-chan struct{}) error {
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+	for relist := false; ; relist = true {
+		list, err := s.list(ctx)
+		if err == nil {
+			// Changes made since the expired version are only seen in the
+			// new list.
+			if relist {
+				notifyChange(changes)
+			}
+			err = s.watch(ctx, changes, list.Metadata.ResourceVersion)
+		}
+		if err == errKubernetesGone {
+			continue
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		return err
+	}
+}
+
+func (s *kubernetesSource) watch(ctx context.Context, changes chan<- struct{}, resourceVersion string) error {
+	rsp, err := s.get(ctx, resourceVersion, true)
+	if err == errKubernetesGone {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error watching pods: %s", err)
+	}
+	defer rsp.Body.Close()
+	decoder := json.NewDecoder(rsp.Body)
+	for {
+		var ev kubernetesWatchEvent
+		err = decoder.Decode(&ev)
+		if err == io.EOF {
+			return errors.New("kubernetes watch closed")
+		}
+		if err != nil {
+			return err
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			notifyChange(changes)
+		case "ERROR":
+			var status struct {
+				Code int `json:"code"`
+			}
+			if json.Unmarshal(ev.Object, &status) == nil && status.Code == http.StatusGone {
+				return errKubernetesGone
+			}
+			return fmt.Errorf("kubernetes watch error: %s", string(ev.Object))
+		}
+	}
+}
+
+func (s *kubernetesSource) get(ctx context.Context, resourceVersion string, watch bool) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("fieldSelector", "spec.nodeName="+s.nodeName)
+	query.Set("labelSelector", s.labelSelector)
+	if resourceVersion != "" {
+		query.Set("resourceVersion", resourceVersion)
+	}
+	if watch {
+		query.Set("watch", "true")
+	}
+	req, err := http.NewRequest("GET", s.apiURL+"/api/v1/pods?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.tokenFile != "" {
+		// The token is read on every request as service account tokens are
+		// rotated by the kubelet.
+		token, err := ioutil.ReadFile(s.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	rsp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode == http.StatusGone {
+		rsp.Body.Close()
+		return nil, errKubernetesGone
+	}
+	if rsp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d: %s", rsp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return rsp, nil
+}
+
+// podIPs returns the IPv4 addresses of the pod, preferring the podIPs field
+// filled by dual-stack aware clusters.
+func podIPs(pod *kubernetesPod) []string {
+	candidates := []string{pod.Status.PodIP}
+	if len(pod.Status.PodIPs) > 0 {
+		candidates = candidates[:0]
+		for _, podIP := range pod.Status.PodIPs {
+			candidates = append(candidates, podIP.IP)
+		}
+	}
+	var ips []string
+	for _, candidate := range candidates {
+		ip := net.ParseIP(candidate)
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
@@ -0,0 +1,252 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+const fakePodList = `{
+  "kind": "PodList",
+  "apiVersion": "v1",
+  "metadata": {"resourceVersion": "1234"},
+  "items": [
+    {
+      "metadata": {"name": "web-1", "namespace": "default", "uid": "uid-1", "labels": {"router": "fusis"}},
+      "spec": {"nodeName": "node-1"},
+      "status": {"phase": "Running", "podIP": "10.2.0.5", "podIPs": [{"ip": "10.2.0.5"}, {"ip": "fd00::5"}]}
+    },
+    {
+      "metadata": {"name": "web-2", "namespace": "prod", "uid": "uid-2", "labels": {"router": "fusis"}},
+      "spec": {"nodeName": "node-1"},
+      "status": {"phase": "Running", "podIP": "10.2.0.6"}
+    },
+    {
+      "metadata": {"name": "web-3", "namespace": "default", "uid": "uid-3", "labels": {"router": "fusis"}},
+      "spec": {"nodeName": "node-1"},
+      "status": {"phase": "Pending"}
+    },
+    {
+      "metadata": {"name": "proxy", "namespace": "default", "uid": "uid-4", "labels": {"router": "fusis"}},
+      "spec": {"nodeName": "node-1", "hostNetwork": true},
+      "status": {"phase": "Running", "podIP": "192.168.0.10"}
+    }
+  ]
+}`
+
+type fakeKubeAPI struct {
+	sync.Mutex
+	requests []*http.Request
+	events   []string
+	// expired is how many watches still end with a 410 error event.
+	expired int
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.requests = append(f.requests, r)
+	events := f.events
+	expired := f.expired > 0 && r.URL.Query().Get("watch") == "true"
+	if expired {
+		f.expired--
+	}
+	f.Unlock()
+	if r.Header.Get("Authorization") != "Bearer secret-token" {
+		http.Error(w, `{"kind":"Status","message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/api/v1/pods" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("watch") != "true" {
+		w.Write([]byte(fakePodList))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if expired {
+		w.Write([]byte(`{"type":"ERROR","object":{"kind":"Status","code":410}}` + "\n"))
+		return
+	}
+	for _, ev := range events {
+		w.Write([]byte(ev + "\n"))
+	}
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+func (f *fakeKubeAPI) lastRequest() *http.Request {
+	f.Lock()
+	defer f.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+func (f *fakeKubeAPI) watches() int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r.URL.Query().Get("watch") == "true" {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *S) newKubernetesSource(c *check.C, apiURL string) *kubernetesSource {
+	tokenFile, err := ioutil.TempFile("", "token")
+	c.Assert(err, check.IsNil)
+	_, err = tokenFile.Write([]byte("secret-token\n"))
+	c.Assert(err, check.IsNil)
+	tokenFile.Close()
+	src, err := newKubernetesSource(apiURL, tokenFile.Name(), "", "node-1", "router=fusis")
+	c.Assert(err, check.IsNil)
+	return src
+}
+
+func (s *S) TestKubernetesSourceList(c *check.C) {
+	api := &fakeKubeAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	src := s.newKubernetesSource(c, srv.URL)
+	defer os.Remove(src.tokenFile)
+	workloads, err := src.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{ID: "uid-1", Name: "default/web-1", Labels: map[string]string{"router": "fusis"}, IPs: []string{"10.2.0.5"}},
+		{ID: "uid-2", Name: "prod/web-2", Labels: map[string]string{"router": "fusis"}, IPs: []string{"10.2.0.6"}},
+	})
+	query := api.lastRequest().URL.Query()
+	c.Assert(query.Get("fieldSelector"), check.Equals, "spec.nodeName=node-1")
+	c.Assert(query.Get("labelSelector"), check.Equals, "router=fusis")
+	c.Assert(query.Get("watch"), check.Equals, "")
+}
+
+func (s *S) TestKubernetesSourceListUnauthorized(c *check.C) {
+	api := &fakeKubeAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	src := s.newKubernetesSource(c, srv.URL)
+	defer os.Remove(src.tokenFile)
+	err := ioutil.WriteFile(src.tokenFile, []byte("other-token"), 0600)
+	c.Assert(err, check.IsNil)
+	_, err = src.List(context.Background())
+	c.Assert(err, check.ErrorMatches, `error listing pods: unexpected status 401: {"kind":"Status","message":"Unauthorized"}`)
+}
+
+func (s *S) TestKubernetesSourceWatch(c *check.C) {
+	pod, err := json.Marshal(map[string]interface{}{"metadata": map[string]string{"name": "web-1"}})
+	c.Assert(err, check.IsNil)
+	api := &fakeKubeAPI{
+		events: []string{`{"type":"BOOKMARK","object":{}}`, `{"type":"MODIFIED","object":` + string(pod) + `}`},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	src := s.newKubernetesSource(c, srv.URL)
+	defer os.Remove(src.tokenFile)
+	changes := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- src.Watch(changes, stop)
+	}()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for change notification")
+	}
+	query := api.lastRequest().URL.Query()
+	c.Assert(query.Get("watch"), check.Equals, "true")
+	c.Assert(query.Get("resourceVersion"), check.Equals, "1234")
+	c.Assert(query.Get("fieldSelector"), check.Equals, "spec.nodeName=node-1")
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
+
+func (s *S) TestKubernetesSourceWatchError(c *check.C) {
+	api := &fakeKubeAPI{
+		events: []string{`{"type":"ERROR","object":{"kind":"Status","code":500}}`},
+	}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	src := s.newKubernetesSource(c, srv.URL)
+	defer os.Remove(src.tokenFile)
+	err := src.Watch(make(chan struct{}, 1), make(chan struct{}))
+	c.Assert(err, check.ErrorMatches, `kubernetes watch error: {"kind":"Status","code":500}`)
+}
+
+func (s *S) TestKubernetesSourceWatchExpired(c *check.C) {
+	api := &fakeKubeAPI{expired: 1}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	src := s.newKubernetesSource(c, srv.URL)
+	defer os.Remove(src.tokenFile)
+	changes := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- src.Watch(changes, stop)
+	}()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for change notification")
+	}
+	for i := 0; api.watches() < 2; i++ {
+		if i == 500 {
+			c.Fatal("timeout waiting for the watch to be restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+	api.Lock()
+	defer api.Unlock()
+	var requests []string
+	for _, r := range api.requests {
+		query := r.URL.Query()
+		requests = append(requests, query.Get("watch")+" "+query.Get("resourceVersion"))
+	}
+	c.Assert(requests, check.DeepEquals, []string{" ", "true 1234", " ", "true 1234"})
+}
+
+func (s *S) TestNewKubernetesSourceInCluster(c *check.C) {
+	oldHost, oldPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	defer func() {
+		os.Setenv("KUBERNETES_SERVICE_HOST", oldHost)
+		os.Setenv("KUBERNETES_SERVICE_PORT", oldPort)
+	}()
+	os.Setenv("KUBERNETES_SERVICE_HOST", "")
+	_, err := newKubernetesSource("", "", "", "node-1", "router=fusis")
+	c.Assert(err, check.ErrorMatches, "kubernetes API address is mandatory when running outside a cluster")
+	_, err = newKubernetesSource("", "", "", "", "router=fusis")
+	c.Assert(err, check.ErrorMatches, "kubernetes node name is mandatory")
+	os.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	os.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	_, err = newKubernetesSource("", "", "/nonexistent/ca.crt", "node-1", "router=fusis")
+	c.Assert(err, check.ErrorMatches, "unable to read kubernetes CA: .*no such file or directory")
+}
+
+func (s *S) TestAgentInitKubernetes(c *check.C) {
+	a := Agent{
+		Runtime:       RuntimeKubernetes,
+		KubernetesAPI: "https://10.96.0.1",
+		NodeName:      "node-1",
+		FusisAddress:  "10.0.0.1",
+		LabelFilter:   "router=fusis",
+		Interval:      time.Second,
+	}
+	err := a.Init()
+	c.Assert(err, check.IsNil)
+	src := a.source.(*kubernetesSource)
+	c.Assert(src.apiURL, check.Equals, "https://10.96.0.1")
+	c.Assert(src.nodeName, check.Equals, "node-1")
+	c.Assert(src.labelSelector, check.Equals, "router=fusis")
+}
@@ -0,0 +1,7 @@
+package agent
+
+import "expvar"
+
+// metrics are published using expvar, served in /debug/vars by the default
+// HTTP mux.
+var metrics = expvar.NewMap("fusis_agent")
@@ -1,111 +1,785 @@
 package agent
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"log"
+	"net"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Defaults used by NATApplier for options not set.
 const (
-	routingTableID    = 100
-	routingTableName  = "fusis.out"
-	ipTablesChainName = "FUSIS"
-	ipMark            = "9"
+	DefaultTableID   = 100
+	DefaultTableName = "fusis.out"
+	// DefaultRulePriority is the one the kernel assigns to the first rule
+	// added without a priority, right before the main table.
+	DefaultRulePriority = 32765
+	DefaultChain        = "FUSIS"
+	DefaultMark         = "9"
 )
 
 var (
-	ipRouteFile = "/etc/iproute2/rt_tables"
+	// conntrackFlush deletes the conntrack entries of addresses in a network
+	// namespace.
+	conntrackFlush = flushConntrack
+
+	// ownChangeDelay is how long after Apply or Cleanup drift notifications
+	// are still ignored, the ones caused by their changes may not have been
+	// read yet.
+	ownChangeDelay = time.Second
 )
 
-type natApplier struct {
+// Applier configures the host so traffic from backends is routed through
+// their fusis router.
+type Applier interface {
+	// Apply makes backends the only ones configured by the applier.
+	Apply(ctx context.Context, backends []Backend) error
+	// Verify compares what's configured with backends, returning a
+	// description of each difference found.
+	Verify(ctx context.Context, backends []Backend) ([]string, error)
+	// Cleanup removes anything configured by a previous run, described by
+	// old, which isn't used by the applier configuration.
+	Cleanup(ctx context.Context, old *State) error
+}
+
+// DriftWatcher may be implemented by appliers able to notice, as they happen,
+// changes made by someone else to what they configured.
+type DriftWatcher interface {
+	// WatchDrift calls fn describing each change until stop is closed.
+	WatchDrift(stop <-chan struct{}, fn func(reason string)) error
+}
+
+// NATOptions configures a NATApplier.
+type NATOptions struct {
+	// Router is the fusis router address, mandatory.
+	Router string
+	// TableID is the routing table with the default route through Router,
+	// DefaultTableID if zero. TableName is its name, DefaultTableName if
+	// empty, defined by a drop-in under rt_tables.d if TableDropIn is set.
+	TableID     int
+	TableName   string
+	TableDropIn bool
+	// RulePriority is the priority of the rule looking up the table for
+	// marked packets, DefaultRulePriority if zero.
+	RulePriority int
+	// Chain is the mangle chain marking packets from backends, DefaultChain
+	// if empty.
+	Chain string
+	// Mark is the firewall mark routed using the table, DefaultMark if empty.
+	Mark string
+	// Executor runs the ip and iptables commands. If nil they're run using
+	// sudo, as with SudoExecutor, Agent.Init passes the executor selected by
+	// Agent.Executor instead.
+	Executor Executor
+	// NetNamespace is the path of the network namespace to configure, where
+	// commands are run using nsenter, instead of the current one.
+	NetNamespace string
+	// Tunnel is TunnelIPIP or TunnelGRE to route through a tunnel to the
+	// router, when it isn't reachable on-link, instead of using it as
+	// gateway.
+	Tunnel string
+	// TunnelName is the tunnel interface, DefaultTunnelName if empty.
+	TunnelName string
+	// TunnelLocal is the local address of the tunnel, chosen by the kernel
+	// if empty.
+	TunnelLocal string
+	// TunnelMTU is the tunnel interface MTU, by default the one of an
+	// ethernet link minus the encapsulation overhead.
+	TunnelMTU int
+	// FlushConntrack deletes the conntrack entries of addresses no longer
+	// used by backends, so established connections aren't kept by a new
+	// workload reusing them. It requires CAP_NET_ADMIN.
+	FlushConntrack bool
+	// Aggregate marks backend addresses with the minimal set of prefixes
+	// covering exactly them, instead of a rule for each address.
+	Aggregate bool
+	// Sysctl is SysctlCheck to report kernel parameters breaking replies
+	// routed through the router, SysctlSet to also change them, restoring
+	// the original values once not set anymore, or SysctlIgnore, the
+	// default.
+	Sysctl string
+}
+
+// NATApplier marks packets from backends in the mangle table, routing
+// marked packets through a table whose default route is the fusis router,
+// which then forwards the replies to the clients.
+type NATApplier struct {
+	opts NATOptions
+
+	mu sync.Mutex
+	// originals are the values of kernel parameters before being set.
+	originals map[string]string
+	problems  []string
+	// legacyChecked is set once rt_tables was checked for the table name
+	// appended by older versions.
+	legacyChecked bool
+	// changing counts the calls to Apply and Cleanup in progress and
+	// changedAt is when the last one returned. Drift notifications are
+	// ignored meanwhile, as they're caused by the applier itself.
+	changing  int
+	changedAt time.Time
 }
 
-func (a *natApplier) Apply(ips []string, fusisIP string) (err error) {
-	err = a.createRoutingTable()
+var (
+	_ Applier         = &NATApplier{}
+	_ DriftWatcher    = &NATApplier{}
+	_ ProblemReporter = &NATApplier{}
+)
+
+// NewNATApplier returns an applier using opts, with defaults for options
+// not set.
+func NewNATApplier(opts NATOptions) (*NATApplier, error) {
+	if opts.Router == "" {
+		return nil, errors.New("router is mandatory")
+	}
+	if ip := net.ParseIP(opts.Router); ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid router address %q", opts.Router)
+	}
+	if opts.TableID == 0 {
+		opts.TableID = DefaultTableID
+	}
+	if _, reserved := reservedTables[opts.TableID]; reserved || opts.TableID < 0 {
+		return nil, fmt.Errorf("invalid table ID %d", opts.TableID)
+	}
+	if opts.TableName == "" {
+		opts.TableName = DefaultTableName
+	}
+	if opts.RulePriority == 0 {
+		opts.RulePriority = DefaultRulePriority
+	}
+	// Rules after the main table would never be reached.
+	if opts.RulePriority < 0 || opts.RulePriority > DefaultRulePriority {
+		return nil, fmt.Errorf("invalid rule priority %d", opts.RulePriority)
+	}
+	if opts.Chain == "" {
+		opts.Chain = DefaultChain
+	}
+	if opts.Mark == "" {
+		opts.Mark = DefaultMark
+	}
+	if _, err := strconv.ParseUint(opts.Mark, 0, 32); err != nil {
+		return nil, fmt.Errorf("invalid mark %q", opts.Mark)
+	}
+	switch opts.Sysctl {
+	case "":
+		opts.Sysctl = SysctlIgnore
+	case SysctlIgnore, SysctlCheck, SysctlSet:
+	default:
+		return nil, fmt.Errorf("unknown sysctl mode %q", opts.Sysctl)
+	}
+	err := setTunnelDefaults(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return &NATApplier{opts: opts, originals: make(map[string]string)}, nil
+}
+
+// Options returns the options used by the applier, including defaults.
+func (a *NATApplier) Options() NATOptions {
+	return a.opts
+}
+
+func (a *NATApplier) executor() Executor {
+	exec := executorOrDefault(a.opts.Executor)
+	if a.opts.NetNamespace != "" {
+		exec = NetnsExecutor{Executor: exec, Path: a.opts.NetNamespace}
+	}
+	return exec
+}
+
+func (a *NATApplier) mangle() *ipTables {
+	return &ipTables{Table: "mangle", executor: a.executor()}
+}
+
+// describe fills the fields of state describing the applier configuration.
+func (a *NATApplier) describe(state *State) {
+	state.Router = a.opts.Router
+	state.Mark = a.opts.Mark
+	state.TableID = a.opts.TableID
+	state.TableName = ""
+	state.TableFile = a.tableFile()
+	if state.TableFile != "" {
+		state.TableName = a.opts.TableName
+	}
+	state.Chain = a.opts.Chain
+	state.Tunnel = a.opts.TunnelName
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	state.Sysctls = nil
+	if len(a.originals) > 0 {
+		state.Sysctls = make(map[string]string, len(a.originals))
+		for key, value := range a.originals {
+			state.Sysctls[key] = value
+		}
+	}
+}
+
+// Problems returns the table names conflicting with the applier table, the
+// rules taking precedence over its rule and, in SysctlCheck mode, the kernel
+// parameters found misconfigured by the last Apply.
+func (a *NATApplier) Problems() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.problems
+}
+
+// checkRouters ensures backends are all routed through the applier router.
+func (a *NATApplier) checkRouters(backends []Backend) error {
+	for _, b := range backends {
+		if b.Router != "" && b.Router != a.opts.Router {
+			return fmt.Errorf("backend %s uses router %s, only %s is supported", b.target(), b.Router, a.opts.Router)
+		}
+	}
+	return nil
+}
+
+func (a *NATApplier) Apply(ctx context.Context, backends []Backend) (err error) {
+	a.beginChange()
+	defer a.endChange()
+	err = a.checkRouters(backends)
 	if err != nil {
 		return err
 	}
-	err = a.createRoutingRules(fusisIP)
+	conflicts, err := a.checkTableNames()
 	if err != nil {
 		return err
 	}
-	table := ipTables{Table: "mangle"}
-	err = table.New("-N", ipTablesChainName)
-	if err != nil && err != errChainExists {
+	if a.opts.Tunnel != "" {
+		err = a.createTunnel(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	problems, err := a.createRoutingRules(ctx)
+	if err != nil {
 		return err
 	}
-	err = table.NewIfNotExists("-I", "PREROUTING", "-j", ipTablesChainName)
+	problems = append(conflicts, problems...)
+	sysctlProblems, err := a.checkSysctls(ctx, backends)
 	if err != nil {
 		return err
 	}
-	toAddMap := make(map[string]struct{})
-	for _, ip := range ips {
-		toAddMap[ip] = struct{}{}
+	problems = append(problems, sysctlProblems...)
+	a.mu.Lock()
+	a.problems = problems
+	a.mu.Unlock()
+	table := a.mangle()
+	current, err := table.Save(ctx)
+	if err != nil {
+		return err
 	}
-	currentIPs, err := table.ListSource(ipTablesChainName)
+	chain, err := a.ensureChain(ctx, table, current, "PREROUTING", a.opts.Chain)
 	if err != nil {
 		return err
 	}
-	var toAdd, toRemove []string
-	for _, ip := range currentIPs {
-		if _, isPresent := toAddMap[ip]; isPresent {
-			delete(toAddMap, ip)
-		} else {
-			toRemove = append(toRemove, ip)
+	if a.opts.Tunnel != "" {
+		err = a.ensureMSSClamp(ctx, table, current)
+		if err != nil {
+			return err
+		}
+	}
+	ipBackends, portBackends := splitBackends(backends)
+	removed, errors := a.syncChain(ctx, table, chain, a.markedBackends(ipBackends))
+	if len(portBackends) > 0 || current.Chain(a.outputChain()) != nil {
+		outChain, err := a.ensureChain(ctx, table, current, "OUTPUT", a.outputChain())
+		if err != nil {
+			return err
 		}
+		_, outErrors := a.syncChain(ctx, table, outChain, portBackends)
+		errors = append(errors, outErrors...)
+	}
+	flushed, err := a.flushConntrack(ctx, unusedAddrs(removed, ipBackends))
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("error flushing conntrack entries: %s", err))
 	}
-	// Transform back to slice so we can sort it and have predictable entries
-	// in iptables.
-	for ip := range toAddMap {
-		toAdd = append(toAdd, ip)
+	if flushed > 0 {
+		log.Printf("flushed %d conntrack entries of removed backends", flushed)
 	}
-	sort.Strings(toAdd)
-	sort.Strings(toRemove)
+	if len(errors) > 0 {
+		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return nil
+}
+
+// Cleanup removes the rules, routes and chain left by a previous
+// configuration, described by old, which are not used by the current one.
+func (a *NATApplier) Cleanup(ctx context.Context, old *State) error {
+	a.beginChange()
+	defer a.endChange()
 	var errors []string
-	for _, ip := range toAdd {
-		err = table.New("-A", ipTablesChainName, "-s", ip, "-j", "MARK", "--set-mark", ipMark)
+	if old.Chain != "" && old.Chain != a.opts.Chain {
+		err := a.removeChain(ctx, old.Chain, "PREROUTING")
 		if err != nil {
-			errors = append(errors, fmt.Sprintf("error adding rule for %s: %s", ip, err))
+			errors = append(errors, fmt.Sprintf("error removing chain %s: %s", old.Chain, err))
 		}
+		err = a.removeChain(ctx, outputChain(old.Chain), "OUTPUT")
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error removing chain %s: %s", outputChain(old.Chain), err))
+		}
+	}
+	oldTable := strconv.Itoa(old.TableID)
+	if old.TableID == 0 {
+		oldTable = old.TableName
 	}
-	for _, ip := range toRemove {
-		err = table.New("-D", ipTablesChainName, "-s", ip, "-j", "MARK", "--set-mark", ipMark)
+	if old.Mark != "" && (old.Mark != a.opts.Mark || old.TableID != a.opts.TableID) {
+		rule := ipRule{executor: a.executor()}
+		err := rule.Del(ctx, old.Mark, oldTable)
+		if err != nil && err != errNoSuchRule {
+			errors = append(errors, fmt.Sprintf("error removing rule for mark %s: %s", old.Mark, err))
+		}
+	}
+	errors = append(errors, a.cleanupTunnel(ctx, old)...)
+	err := a.cleanupTableName(old)
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("error removing table name: %s", err))
+	}
+	if len(old.Sysctls) > 0 {
+		if a.opts.Sysctl == SysctlSet {
+			// Still set, the original values are kept to be restored later.
+			a.mu.Lock()
+			for key, value := range old.Sysctls {
+				a.originals[key] = value
+			}
+			a.mu.Unlock()
+		} else {
+			errors = append(errors, a.restoreSysctls(ctx, old.Sysctls)...)
+		}
+	}
+	route := ipRoute{executor: a.executor()}
+	switch {
+	case old.TableID != 0 && old.TableID != a.opts.TableID:
+		err := route.Flush(ctx, strconv.Itoa(old.TableID))
 		if err != nil {
-			errors = append(errors, fmt.Sprintf("error removing rule for %s: %s", ip, err))
+			errors = append(errors, fmt.Sprintf("error flushing table %d: %s", old.TableID, err))
+		}
+	case old.Tunnel == "" && old.Router != "" && old.Router != a.opts.Router:
+		err := route.DelDefault(ctx, old.Router, a.table())
+		if err != nil && err != errNoSuchRule {
+			errors = append(errors, fmt.Sprintf("error removing route via %s: %s", old.Router, err))
 		}
 	}
 	if len(errors) > 0 {
 		return fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
 	}
-	return err
+	return nil
+}
+
+// ensureChain creates chain when it's missing from current and ensures the
+// built-in chain jumps to it, returning its current rules.
+func (a *NATApplier) ensureChain(ctx context.Context, table *ipTables, current *iptablesTable, builtin, name string) (*iptablesChain, error) {
+	chain := current.Chain(name)
+	if chain == nil {
+		err := table.New(ctx, "-N", name)
+		if err != nil && err != errChainExists {
+			return nil, err
+		}
+		chain = &iptablesChain{Name: name}
+	}
+	return chain, a.ensureJump(ctx, table, current, builtin, name)
+}
+
+// markedBackends returns the backends marked by a rule each, with their
+// addresses aggregated in prefixes if enabled.
+func (a *NATApplier) markedBackends(backends []Backend) []Backend {
+	if a.opts.Aggregate {
+		return aggregateBackends(backends)
+	}
+	return backends
 }
 
-func (a *natApplier) createRoutingTable() error {
-	data, err := ioutil.ReadFile(ipRouteFile)
+// syncChain adds and removes rules so chain marks exactly the packets from
+// backends. It returns the addresses, or prefixes, whose rules were removed,
+// along with the errors found.
+func (a *NATApplier) syncChain(ctx context.Context, table *ipTables, chain *iptablesChain, backends []Backend) ([]string, []string) {
+	toAdd, toRemove := a.diffRules(chain, backends)
+	var errors, removed []string
+	for _, b := range toAdd {
+		args, err := a.markRuleArgs(b)
+		if err == nil {
+			err = table.New(ctx, append([]string{"-A", chain.Name}, args...)...)
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error adding rule for %s: %s", b, err))
+		}
+	}
+	for _, removal := range toRemove {
+		if removal.reason != "" {
+			log.Printf("removing %s from chain %s: %s", removal.reason, chain.Name, removal.rule)
+		}
+		err := table.New(ctx, append([]string{"-D", chain.Name}, removal.rule.Args...)...)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error removing rule %q: %s", removal.rule, err))
+			continue
+		}
+		if removal.reason == "" {
+			target, _, _ := parseMarkRule(&removal.rule, a.opts.Mark)
+			if _, ok := expandPrefix(target); ok {
+				removed = append(removed, target)
+			}
+		}
+	}
+	if len(toAdd) > 0 || len(toRemove) > 0 {
+		log.Printf("updated chain %s: %d rules added, %d removed", chain.Name, len(toAdd), len(toRemove))
+	}
+	return removed, errors
+}
+
+// flushConntrack deletes the conntrack entries of ips, if enabled, returning
+// how many were deleted.
+func (a *NATApplier) flushConntrack(ctx context.Context, ips []string) (int, error) {
+	if !a.opts.FlushConntrack || len(ips) == 0 {
+		return 0, nil
+	}
+	flushed, err := conntrackFlush(ctx, a.opts.NetNamespace, ips)
+	metrics.Add("conntrack_flushed", int64(flushed))
+	return flushed, err
+}
+
+// removeChain removes chain and the jumps to it from the built-in chain, if
+// it exists.
+func (a *NATApplier) removeChain(ctx context.Context, chain, builtin string) error {
+	table := a.mangle()
+	current, err := table.Save(ctx)
 	if err != nil {
 		return err
 	}
-	if bytes.Contains(data, []byte(routingTableName)) {
+	if current.Chain(chain) == nil {
 		return nil
 	}
-	file, err := os.OpenFile(ipRouteFile, os.O_RDWR|os.O_APPEND, 0644)
+	for jumps := countJumps(current.Chain(builtin), chain); jumps > 0; jumps-- {
+		err = table.New(ctx, "-D", builtin, "-j", chain)
+		if err != nil {
+			return err
+		}
+	}
+	err = table.New(ctx, "-F", chain)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	_, err = file.Write([]byte(fmt.Sprintf("\n%d %s\n", routingTableID, routingTableName)))
-	return err
+	return table.New(ctx, "-X", chain)
+}
+
+// Verify compares the current rules with the ones expected for backends,
+// returning a description of each difference found.
+func (a *NATApplier) Verify(ctx context.Context, backends []Backend) ([]string, error) {
+	current, err := a.mangle().Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chain := current.Chain(a.opts.Chain)
+	if chain == nil {
+		return []string{fmt.Sprintf("chain %s missing", a.opts.Chain)}, nil
+	}
+	var drift []string
+	if jumps := countJumps(current.Chain("PREROUTING"), a.opts.Chain); jumps != 1 {
+		drift = append(drift, fmt.Sprintf("%d jumps to chain %s in PREROUTING", jumps, a.opts.Chain))
+	}
+	if a.opts.Tunnel != "" {
+		drift = append(drift, a.verifyMSSClamp(current)...)
+	}
+	ipBackends, portBackends := splitBackends(backends)
+	drift = append(drift, a.verifyRules(chain, a.markedBackends(ipBackends))...)
+	drift = append(drift, a.verifyOutputChain(current, portBackends)...)
+	return drift, nil
+}
+
+// verifyRules describes the differences between the rules in chain and the
+// ones expected for backends.
+func (a *NATApplier) verifyRules(chain *iptablesChain, backends []Backend) []string {
+	var drift []string
+	toAdd, toRemove := a.diffRules(chain, backends)
+	for _, b := range toAdd {
+		drift = append(drift, fmt.Sprintf("missing rule for %s", b))
+	}
+	for _, removal := range toRemove {
+		reason := removal.reason
+		if reason == "" {
+			reason = "stale rule"
+		}
+		drift = append(drift, fmt.Sprintf("%s %s", reason, removal.rule))
+	}
+	return drift
+}
+
+// WatchDrift calls fn whenever a rule or route in the routing table is
+// removed by someone else, until stop is closed. Removals made around the
+// time the applier itself changes the table are ignored, they're noticed by
+// Verify if external.
+func (a *NATApplier) WatchDrift(stop <-chan struct{}, fn func(reason string)) error {
+	return watchRoutingTable(a.opts.NetNamespace, uint32(a.opts.TableID), stop, func(reason string) {
+		if !a.ownChange() {
+			fn(reason)
+		}
+	})
 }
 
-func (a *natApplier) createRoutingRules(fusisIP string) error {
-	route := ipRoute{}
-	err := route.AddDefault(fusisIP, routingTableName)
+func (a *NATApplier) beginChange() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.changing++
+}
+
+func (a *NATApplier) endChange() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.changing--
+	a.changedAt = time.Now()
+}
+
+// ownChange returns whether changes to the routing table may have been made
+// by the applier right now.
+func (a *NATApplier) ownChange() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.changing > 0 || time.Since(a.changedAt) < ownChangeDelay
+}
+
+// ensureJump ensures the built-in chain has exactly one unconditional jump
+// to target, inserted as its first rule when missing.
+func (a *NATApplier) ensureJump(ctx context.Context, table *ipTables, current *iptablesTable, builtin, target string) error {
+	jumps := countJumps(current.Chain(builtin), target)
+	if jumps == 0 {
+		return table.New(ctx, "-I", builtin, "-j", target)
+	}
+	for ; jumps > 1; jumps-- {
+		log.Printf("removing duplicated jump to chain %s from %s", target, builtin)
+		err := table.New(ctx, "-D", builtin, "-j", target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countJumps returns the number of unconditional jumps to target in chain.
+func countJumps(chain *iptablesChain, target string) int {
+	var jumps int
+	if chain != nil {
+		for _, rule := range chain.Rules {
+			if rule.Equal("-j", target) {
+				jumps++
+			}
+		}
+	}
+	return jumps
+}
+
+// ruleRemoval is a rule which must be removed from the chain, reason is empty
+// for rules which were created by the agent for addresses no longer used.
+type ruleRemoval struct {
+	rule   iptablesRule
+	reason string
+}
+
+// diffRules compares the rules in chain with the ones expected for backends,
+// returning the backends missing a rule and the rules which must be removed:
+// rules for other addresses or ports, duplicates, rules with a different
+// mark or comment and any rule not created by the agent.
+func (a *NATApplier) diffRules(chain *iptablesChain, backends []Backend) ([]Backend, []ruleRemoval) {
+	wanted := make(map[string]*Backend)
+	for i := range backends {
+		wanted[backends[i].target()] = &backends[i]
+	}
+	found := make(map[string]bool)
+	var toRemove []ruleRemoval
+	for _, rule := range chain.Rules {
+		target, comment, isMarkRule := parseMarkRule(&rule, a.opts.Mark)
+		backend, isWanted := wanted[target]
+		removal := ruleRemoval{rule: rule}
+		switch {
+		case !isMarkRule:
+			removal.reason = "unexpected rule"
+		case found[target]:
+			removal.reason = "duplicated rule"
+		case isWanted && comment != ruleComment(backend):
+			removal.reason = "outdated rule"
+		case isWanted:
+			found[target] = true
+			continue
+		}
+		toRemove = append(toRemove, removal)
+	}
+	// Sorted so we have predictable entries in iptables.
+	var toAdd []Backend
+	for _, b := range backends {
+		if !found[b.target()] {
+			found[b.target()] = true
+			toAdd = append(toAdd, b)
+		}
+	}
+	sort.Sort(backendsByIP(toAdd))
+	return toAdd, toRemove
+}
+
+// maxCommentLength is the longest comment accepted by the iptables comment
+// match.
+const maxCommentLength = 255
+
+// ruleComment returns the comment identifying the backend in its rule. The
+// process of backends marked by cgroup is included, so rules are replaced
+// when the container restarts with a new cgroup in the same path.
+func ruleComment(b *Backend) string {
+	comment := b.ContainerID
+	if b.Cgroup != "" {
+		comment = strings.TrimSpace(fmt.Sprintf("%s pid %d", comment, b.Pid))
+	}
+	if len(comment) > maxCommentLength {
+		return comment[:maxCommentLength]
+	}
+	return comment
+}
+
+// markRuleArgs returns the arguments of the rule marking packets from b, by
+// source address, port or cgroup, tagged with its container ID.
+func (a *NATApplier) markRuleArgs(b Backend) ([]string, error) {
+	args := []string{"-s", b.IP}
+	switch {
+	case b.Cgroup != "":
+		args = []string{"-m", "cgroup", "--path", b.Cgroup}
+	case b.Port != "":
+		ports, err := parsePorts(b.Port)
+		// Only the canonical form matches the rules parsed by parseMarkRule.
+		if err != nil || len(ports) != 1 || ports[0] != b.Port {
+			return nil, fmt.Errorf("invalid port %q", b.Port)
+		}
+		parts := strings.SplitN(ports[0], "/", 2)
+		args = []string{"-p", parts[1], "-m", parts[1], "--sport", parts[0]}
+	}
+	if comment := ruleComment(&b); comment != "" {
+		args = append(args, "-m", "comment", "--comment", comment)
+	}
+	return append(args, "-j", "MARK", "--set-mark", a.opts.Mark), nil
+}
+
+// parseMarkRule returns the target, as in Backend.target, and comment of
+// rule if it's exactly a rule created by the agent, marking a single address,
+// an aggregated prefix, a source port or cgroup with ipMark.
+func parseMarkRule(rule *iptablesRule, ipMark string) (string, string, bool) {
+	mark, _ := strconv.ParseUint(ipMark, 0, 32)
+	args := rule.Args
+	var target string
+	switch {
+	case len(args) >= 4 && args[0] == "-m" && args[1] == "cgroup" && args[2] == "--path":
+		target = Backend{Cgroup: args[3]}.target()
+		args = args[4:]
+	case len(args) >= 6 && args[0] == "-p" && args[2] == "-m" && args[3] == args[1] && args[4] == "--sport":
+		port, err := strconv.Atoi(args[5])
+		if err != nil || (args[1] != "tcp" && args[1] != "udp") {
+			return "", "", false
+		}
+		target = Backend{Port: fmt.Sprintf("%d/%s", port, args[1])}.target()
+		args = args[6:]
+	case len(args) >= 2 && args[0] == "-s":
+		ip, ipNet, err := net.ParseCIDR(args[1])
+		if err != nil || ip.To4() == nil || !ip.Equal(ipNet.IP) {
+			return "", "", false
+		}
+		target = ip.String()
+		if ones, _ := ipNet.Mask.Size(); ones != 32 {
+			target = ipNet.String()
+		}
+		args = args[2:]
+	default:
+		return "", "", false
+	}
+	var comment string
+	if len(args) >= 4 && args[0] == "-m" && args[1] == "comment" && args[2] == "--comment" {
+		comment = args[3]
+		args = args[4:]
+	}
+	if len(args) != 4 || args[0] != "-j" || args[1] != "MARK" {
+		return "", "", false
+	}
+	// Depending on the version iptables-save shows the mark as set by
+	// --set-mark either with or without an explicit mask.
+	switch {
+	case args[2] == "--set-xmark" && args[3] == fmt.Sprintf("0x%x/0xffffffff", mark):
+	case args[2] == "--set-mark" && args[3] == fmt.Sprintf("0x%x", mark):
+	default:
+		return "", "", false
+	}
+	return target, comment, true
+}
+
+func (a *NATApplier) createRoutingRules(ctx context.Context) ([]string, error) {
+	route := ipRoute{executor: a.executor()}
+	var err error
+	if a.opts.Tunnel != "" {
+		err = route.ReplaceDefaultDev(ctx, a.opts.TunnelName, a.table())
+	} else {
+		err = route.AddDefault(ctx, a.opts.Router, a.table())
+	}
 	if err != nil && err != errRouteExists {
-		return err
+		return nil, err
+	}
+	return a.reconcileRules(ctx)
+}
+
+// reconcileRules ensures a single rule looks up the table, for packets with
+// exactly the mark at the configured priority, removing stale and duplicated
+// ones. It returns warnings about rules taking precedence over it which may
+// route marked packets elsewhere.
+func (a *NATApplier) reconcileRules(ctx context.Context) ([]string, error) {
+	rule := ipRule{executor: a.executor()}
+	rules, err := rule.Rules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mark, _, err := parseFwmark(a.opts.Mark)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts, errors []string
+	found := false
+	for _, r := range rules {
+		if !a.ownsRule(r) {
+			if !found && r.Priority <= a.opts.RulePriority && r.Table != "local" && r.MatchesMark(mark) {
+				conflicts = append(conflicts, fmt.Sprintf("rule %q takes precedence over the fusis rule at priority %d", r, a.opts.RulePriority))
+			}
+			continue
+		}
+		reason := "stale"
+		if a.wantedRule(r, mark) {
+			if !found {
+				found = true
+				continue
+			}
+			reason = "duplicated"
+		}
+		log.Printf("removing %s rule %q", reason, r)
+		err = rule.DelEntry(ctx, r)
+		if err != nil && err != errNoSuchRule {
+			errors = append(errors, fmt.Sprintf("error removing rule %q: %s", r, err))
+		}
+	}
+	if !found {
+		err = rule.Add(ctx, a.opts.RulePriority, a.opts.Mark, a.table())
+		if err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if len(errors) > 0 {
+		return nil, fmt.Errorf("multiple errors: %s", strings.Join(errors, " | "))
+	}
+	return conflicts, nil
+}
+
+// ownsRule returns whether r looks up the applier table.
+func (a *NATApplier) ownsRule(r ipRuleEntry) bool {
+	return r.Table == a.opts.TableName || r.Table == a.table()
+}
+
+// wantedRule returns whether r is exactly the rule created by the applier.
+func (a *NATApplier) wantedRule(r ipRuleEntry, mark uint32) bool {
+	if r.Priority != a.opts.RulePriority || r.Other || (r.From != "" && r.From != "all") || r.Mark == "" {
+		return false
 	}
-	rule := ipRule{}
-	return rule.AddIfNotExists(ipMark, routingTableName)
+	value, mask, err := parseFwmark(r.Mark)
+	return err == nil && value == mark && mask == 0xffffffff
 }
@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"context"
+	"fmt"
 	"syscall"
 
 	"gopkg.in/check.v1"
@@ -13,52 +15,56 @@ type RealS struct {
 
 var _ = check.Suite(&RealS{})
 
-func (s *RealS) flushRules() {
-	pkgExecutor.Exec("ip", "rule", "del", "table", routingTableName)
-	pkgExecutor.Exec("ip", "route", "flush", "table", routingTableName)
-	pkgExecutor.Exec("iptables", "-t", "mangle", "-F", "PREROUTING")
-	pkgExecutor.Exec("iptables", "-t", "mangle", "-F", ipTablesChainName)
-	pkgExecutor.Exec("iptables", "-t", "mangle", "-X", ipTablesChainName)
-}
+// testNetNamespace is a throwaway network namespace where rules are applied,
+// leaving the host namespace untouched.
+const testNetNamespace = "fusis-agent-test"
 
 func (s *RealS) SetUpTest(c *check.C) {
 	uid := syscall.Getuid()
 	if uid != 0 {
 		c.Skip("test must run as root")
 	}
-	s.flushRules()
+	host := DirectExecutor{}
+	_, err := host.Exec(context.Background(), "ip", "netns", "add", testNetNamespace)
+	if err != nil {
+		c.Skip(fmt.Sprintf("unable to create network namespace: %s", err))
+	}
+	pkgExecutor = NetnsExecutor{Executor: host, Path: "/var/run/netns/" + testNetNamespace}
+	_, err = pkgExecutor.Exec(context.Background(), "ip", "link", "set", "lo", "up")
+	c.Assert(err, check.IsNil)
 }
 
 func (s *RealS) TearDownTest(c *check.C) {
-	s.flushRules()
+	DirectExecutor{}.Exec(context.Background(), "ip", "netns", "del", testNetNamespace)
 }
 
 func (s *RealS) TestApplyForReal(c *check.C) {
-	nat := natApplier{}
-	err := nat.Apply([]string{"10.9.9.1", "10.9.9.2"}, "127.0.0.1")
+	nat, err := NewNATApplier(NATOptions{Router: "127.0.0.1"})
+	c.Assert(err, check.IsNil)
+	err = nat.Apply(context.Background(), testBackends("10.9.9.1", "10.9.9.2"))
 	c.Assert(err, check.IsNil)
 	tables := ipTables{Table: "mangle"}
-	ips, err := tables.ListSource(ipTablesChainName)
+	ips, err := tables.ListSource(context.Background(), DefaultChain)
 	c.Assert(err, check.IsNil)
 	c.Assert(ips, check.DeepEquals, []string{"10.9.9.1", "10.9.9.2"})
 	rule := ipRule{}
-	data, err := rule.List()
+	data, err := rule.List(context.Background())
 	c.Assert(err, check.IsNil)
-	c.Assert(string(data), check.Matches, `(?s).*from all fwmark 0x9 lookup `+routingTableName+".*")
-	data, err = pkgExecutor.Exec("ip", "route", "list", "table", routingTableName)
+	c.Assert(string(data), check.Matches, `(?s).*from all fwmark 0x9 lookup `+fmt.Sprint(DefaultTableID)+".*")
+	data, err = pkgExecutor.Exec(context.Background(), "ip", "route", "list", "table", fmt.Sprint(DefaultTableID))
 	c.Assert(err, check.IsNil)
 	c.Assert(string(data), check.Matches, `(?s).*default via 127.0.0.1 dev lo.*`)
 
-	err = nat.Apply([]string{"10.9.9.2", "10.9.9.3"}, "127.0.0.1")
+	err = nat.Apply(context.Background(), testBackends("10.9.9.2", "10.9.9.3"))
 	c.Assert(err, check.IsNil)
-	ips, err = tables.ListSource(ipTablesChainName)
+	ips, err = tables.ListSource(context.Background(), DefaultChain)
 	c.Assert(err, check.IsNil)
 	c.Assert(ips, check.DeepEquals, []string{"10.9.9.2", "10.9.9.3"})
 	rule = ipRule{}
-	data, err = rule.List()
+	data, err = rule.List(context.Background())
 	c.Assert(err, check.IsNil)
-	c.Assert(string(data), check.Matches, `(?s).*from all fwmark 0x9 lookup `+routingTableName+".*")
-	data, err = pkgExecutor.Exec("ip", "route", "list", "table", routingTableName)
+	c.Assert(string(data), check.Matches, `(?s).*from all fwmark 0x9 lookup `+fmt.Sprint(DefaultTableID)+".*")
+	data, err = pkgExecutor.Exec(context.Background(), "ip", "route", "list", "table", fmt.Sprint(DefaultTableID))
 	c.Assert(err, check.IsNil)
 	c.Assert(string(data), check.Matches, `(?s).*default via 127.0.0.1 dev lo.*`)
 }
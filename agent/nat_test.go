@@ -1,55 +1,72 @@
 package agent
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/check.v1"
 )
 
+func newTestNAT(c *check.C) *NATApplier {
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1"})
+	c.Assert(err, check.IsNil)
+	return nat
+}
+
+func testBackends(ips ...string) []Backend {
+	backends := make([]Backend, len(ips))
+	for i, ip := range ips {
+		backends[i] = Backend{IP: ip}
+	}
+	return backends
+}
+
 var baseExpected = [][]string{
-	{"ip", "route", "add", "default", "via", "192.168.1.1", "table", "fusis.out"},
+	{"ip", "route", "add", "default", "via", "192.168.1.1", "table", "100"},
 	{"ip", "rule", "list"},
-	{"ip", "rule", "add", "fwmark", "9", "table", "fusis.out"},
-	{"iptables", "-t", "mangle", "-N", "FUSIS"},
-	{"iptables", "-t", "mangle", "-C", "PREROUTING", "-j", "FUSIS"},
+	{"ip", "rule", "add", "pref", "32765", "fwmark", "9", "table", "100"},
 	{"iptables-save", "-t", "mangle"},
+	{"iptables", "-t", "mangle", "-w", "5", "-N", "FUSIS"},
+	{"iptables", "-t", "mangle", "-w", "5", "-I", "PREROUTING", "-j", "FUSIS"},
 }
 
 func (s *S) TestApply(c *check.C) {
-	nat := natApplier{}
-	err := nat.Apply([]string{"10.0.0.1", "10.0.0.2"}, "192.168.1.1")
+	nat := newTestNAT(c)
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1", "10.0.0.2"))
 	c.Assert(err, check.IsNil)
 	expected := append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
 	}...)
 	c.Assert(s.executor.log, check.DeepEquals, expected)
-	err = nat.Apply([]string{"10.0.0.1", "10.0.0.2"}, "192.168.1.1")
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1", "10.0.0.2"))
 	c.Assert(err, check.IsNil)
 	c.Assert(s.executor.log, check.DeepEquals, append(expected, expected...))
-	data, err := ioutil.ReadFile(s.tempfile)
+	files, err := ioutil.ReadDir(s.tempdir)
 	c.Assert(err, check.IsNil)
-	c.Assert(string(data), check.Equals, "\n100 fusis.out\n")
+	c.Assert(files, check.HasLen, 0)
 }
 
 func (s *S) TestApplyDefaultGWErr(c *check.C) {
 	s.executor.results = map[string]fakeResult{
-		"ip route add default via 192.168.1.1 table fusis.out": {data: []byte("RTNETLINK answers: File exists"), err: errors.New("exit 2")},
+		"ip route add default via 192.168.1.1 table 100": {data: []byte("RTNETLINK answers: File exists"), err: errors.New("exit 2")},
 	}
-	nat := natApplier{}
-	err := nat.Apply([]string{"10.0.0.1"}, "192.168.1.1")
+	nat := newTestNAT(c)
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1"))
 	c.Assert(err, check.IsNil)
 	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
 	}...))
 	s.executor.results = map[string]fakeResult{
-		"ip route add default via 192.168.1.1 table fusis.out": {data: []byte("RTNETLINK answers: Unknown error"), err: errors.New("exit 2")},
+		"ip route add default via 192.168.1.1 table 100": {data: []byte("RTNETLINK answers: Unknown error"), err: errors.New("exit 2")},
 	}
-	err = nat.Apply([]string{"10.0.0.1"}, "192.168.1.1")
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1"))
 	c.Assert(err, check.ErrorMatches, "exit 2")
 	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
 		baseExpected[0],
 	}...))
 }
@@ -61,64 +78,107 @@ func (s *S) TestApplyExistingRule(c *check.C) {
 32766:  from all lookup main
 32767:  from all lookup default`)},
 	}
-	nat := natApplier{}
-	err := nat.Apply([]string{"10.0.0.1"}, "192.168.1.1")
+	nat := newTestNAT(c)
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1"))
 	c.Assert(err, check.IsNil)
 	c.Assert(s.executor.log, check.DeepEquals, [][]string{
-		{"ip", "route", "add", "default", "via", "192.168.1.1", "table", "fusis.out"},
+		{"ip", "route", "add", "default", "via", "192.168.1.1", "table", "100"},
 		{"ip", "rule", "list"},
-		{"iptables", "-t", "mangle", "-N", "FUSIS"},
-		{"iptables", "-t", "mangle", "-C", "PREROUTING", "-j", "FUSIS"},
 		{"iptables-save", "-t", "mangle"},
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-N", "FUSIS"},
+		{"iptables", "-t", "mangle", "-w", "5", "-I", "PREROUTING", "-j", "FUSIS"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+	})
+	c.Assert(nat.Problems(), check.IsNil)
+}
+
+func (s *S) TestApplyReconcilesRules(c *check.C) {
+	s.executor.results = map[string]fakeResult{
+		"ip rule list": {data: []byte(`0:	from all lookup local
+90:	from all fwmark 0x9 lookup fusis.out
+95:	from all fwmark 0x1/0x1 lookup vpn
+96:	from 10.0.0.0/8 lookup other
+97:	from all lookup main suppress_prefixlength 0
+98:	from all lookup 100 [detached]
+100:	from all fwmark 0x9 lookup fusis.out
+100:	from all fwmark 0x9 lookup fusis.out
+100:	from all fwmark 0x9/0xff lookup fusis.out
+32766:	from all lookup main
+32767:	from all lookup default
+`)},
+	}
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", RulePriority: 100})
+	c.Assert(err, check.IsNil)
+	err = nat.Apply(context.Background(), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log[:5], check.DeepEquals, [][]string{
+		{"ip", "route", "add", "default", "via", "192.168.1.1", "table", "100"},
+		{"ip", "rule", "list"},
+		{"ip", "rule", "del", "pref", "90", "from", "all", "fwmark", "0x9", "lookup", "fusis.out"},
+		{"ip", "rule", "del", "pref", "98", "from", "all", "lookup", "100"},
+		{"ip", "rule", "del", "pref", "100", "from", "all", "fwmark", "0x9", "lookup", "fusis.out"},
 	})
+	c.Assert(s.executor.log[5], check.DeepEquals, []string{"ip", "rule", "del", "pref", "100", "from", "all", "fwmark", "0x9/0xff", "lookup", "fusis.out"})
+	c.Assert(s.executor.log[6], check.DeepEquals, []string{"iptables-save", "-t", "mangle"})
+	c.Assert(nat.Problems(), check.DeepEquals, []string{
+		`rule "95: from all fwmark 0x1/0x1 lookup vpn" takes precedence over the fusis rule at priority 100`,
+	})
+	s.executor.log = nil
+	s.executor.results = map[string]fakeResult{
+		"ip rule list": {data: []byte("0:	from all lookup local\n50:	from all lookup vpn\n32766:	from all lookup main\n")},
+		"ip rule add pref 100 fwmark 9 table 100": {data: []byte("RTNETLINK answers: Invalid argument"), err: errors.New("exit 2")},
+	}
+	err = nat.Apply(context.Background(), nil)
+	c.Assert(err, check.ErrorMatches, "multiple errors: exit 2")
+	c.Assert(s.executor.log, check.HasLen, 3)
+}
+
+func (s *S) TestParseRules(c *check.C) {
+	rules, err := parseRules([]byte("0:\tfrom all lookup local\n1000:\tnot from all to 10.0.0.0/8 fwmark 0x9 lookup 100\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(rules, check.DeepEquals, []ipRuleEntry{
+		{Priority: 0, Args: []string{"from", "all", "lookup", "local"}, From: "all", Table: "local"},
+		{Priority: 1000, Args: []string{"not", "from", "all", "to", "10.0.0.0/8", "fwmark", "0x9", "lookup", "100"}, From: "all", Mark: "0x9", Table: "100", Other: true},
+	})
+	c.Assert(rules[0].MatchesMark(9), check.Equals, true)
+	c.Assert(rules[1].MatchesMark(9), check.Equals, false)
+	_, err = parseRules([]byte("from all lookup local\n"))
+	c.Assert(err, check.ErrorMatches, `unexpected ip rule output: "from all lookup local"`)
 }
 
 func (s *S) TestApplyChainCreateErr(c *check.C) {
 	s.executor.results = map[string]fakeResult{
-		"iptables -t mangle -N FUSIS": {data: []byte("iptables: Chain already exists."), err: errors.New("exit 1")},
+		"iptables -t mangle -w 5 -N FUSIS": {data: []byte("iptables: Chain already exists."), err: errors.New("exit 1")},
 	}
-	nat := natApplier{}
-	err := nat.Apply([]string{"10.0.0.1"}, "192.168.1.1")
+	nat := newTestNAT(c)
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1"))
 	c.Assert(err, check.IsNil)
 	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
 	}...))
 	s.executor.results = map[string]fakeResult{
-		"iptables -t mangle -N FUSIS": {data: []byte("iptables: Other err."), err: errors.New("exit 1")},
+		"iptables -t mangle -w 5 -N FUSIS": {data: []byte("iptables: Other err."), err: errors.New("exit 1")},
 	}
-	err = nat.Apply([]string{"10.0.0.1"}, "192.168.1.1")
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1"))
 	c.Assert(err, check.ErrorMatches, `exit 1`)
 	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
-		baseExpected[0], baseExpected[1], baseExpected[2], baseExpected[3],
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		baseExpected[0], baseExpected[1], baseExpected[2], baseExpected[3], baseExpected[4],
 	}...))
 }
 
-func (s *S) TestApplyChainJumpCheckErr(c *check.C) {
+func (s *S) TestApplyChainJumpErr(c *check.C) {
 	s.executor.results = map[string]fakeResult{
-		"iptables -t mangle -C PREROUTING -j FUSIS": {data: []byte("iptables: No chain/target/match by that name."), err: errors.New("exit 1")},
-	}
-	nat := natApplier{}
-	err := nat.Apply([]string{"10.0.0.1"}, "192.168.1.1")
-	c.Assert(err, check.IsNil)
-	expected := [][]string{
-		baseExpected[0], baseExpected[1], baseExpected[2], baseExpected[3], baseExpected[4],
-		{"iptables", "-t", "mangle", "-I", "PREROUTING", "-j", "FUSIS"},
-		baseExpected[5],
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		"iptables -t mangle -w 5 -I PREROUTING -j FUSIS": {data: []byte("iptables: Other err."), err: errors.New("exit 1")},
 	}
-	c.Assert(s.executor.log, check.DeepEquals, expected)
-	s.executor.results = map[string]fakeResult{
-		"iptables -t mangle -C PREROUTING -j FUSIS": {data: []byte("iptables: Other err."), err: errors.New("exit 1")},
-	}
-	err = nat.Apply([]string{"10.0.0.1"}, "192.168.1.1")
+	nat := newTestNAT(c)
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1"))
 	c.Assert(err, check.ErrorMatches, `exit 1`)
-	c.Assert(s.executor.log, check.DeepEquals, append(expected, baseExpected[:5]...))
+	c.Assert(s.executor.log, check.DeepEquals, baseExpected)
 }
 
 func (s *S) TestApplyWithExistingIPs(c *check.C) {
-	nat := natApplier{}
+	nat := newTestNAT(c)
 	s.executor.results = map[string]fakeResult{
 		"iptables-save -t mangle": {data: []byte(`
 # Generated by iptables-save v1.4.21 on Wed Jun 29 20:05:01 2016
@@ -136,26 +196,250 @@ COMMIT
 # Completed on Wed Jun 29 20:05:01 2016
 `)},
 	}
-	err := nat.Apply([]string{"10.0.0.1", "10.0.0.2"}, "192.168.1.1")
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1", "10.0.0.2"))
 	c.Assert(err, check.IsNil)
-	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
-		{"iptables", "-t", "mangle", "-D", "FUSIS", "-s", "10.0.0.3", "-j", "MARK", "--set-mark", "9"},
+	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected[:4:4], [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.3/32", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+	}...))
+}
+
+func (s *S) TestApplyFixesDriftedRules(c *check.C) {
+	nat := newTestNAT(c)
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:FUSIS - [0:0]
+-A PREROUTING -j FUSIS
+-A PREROUTING -s 10.1.0.0/16 -j FUSIS
+-A PREROUTING -j FUSIS
+-A FUSIS -s 10.0.0.1/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.1/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.2/32 -j MARK --set-xmark 0x7/0xffffffff
+-A FUSIS -s 10.0.0.3/32 -m comment --comment "added by hand" -j ACCEPT
+COMMIT
+`)},
+	}
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1", "10.0.0.2"))
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected[:4:4], [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "PREROUTING", "-j", "FUSIS"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.1/32", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.2/32", "-j", "MARK", "--set-xmark", "0x7/0xffffffff"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.3/32", "-m", "comment", "--comment", "added by hand", "-j", "ACCEPT"},
 	}...))
 }
 
 func (s *S) TestApplyIpRuleErr(c *check.C) {
-	nat := natApplier{}
+	nat := newTestNAT(c)
 	s.executor.results = map[string]fakeResult{
-		"iptables -t mangle -A FUSIS -s 10.0.0.1 -j MARK --set-mark 9": {data: []byte("something"), err: errors.New("errx1")},
-		"iptables -t mangle -A FUSIS -s 10.0.0.3 -j MARK --set-mark 9": {data: []byte("something"), err: errors.New("errx2")},
+		"iptables -t mangle -w 5 -A FUSIS -s 10.0.0.1 -j MARK --set-mark 9": {data: []byte("something"), err: errors.New("errx1")},
+		"iptables -t mangle -w 5 -A FUSIS -s 10.0.0.3 -j MARK --set-mark 9": {data: []byte("something"), err: errors.New("errx2")},
 	}
-	err := nat.Apply([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, "192.168.1.1")
+	err := nat.Apply(context.Background(), testBackends("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"))
 	c.Assert(err, check.ErrorMatches, `multiple errors: error adding rule for 10.0.0.1: errx1 | error adding rule for 10.0.0.3: errx2`)
 	c.Assert(s.executor.log, check.DeepEquals, append(baseExpected, [][]string{
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.3", "-j", "MARK", "--set-mark", "9"},
-		{"iptables", "-t", "mangle", "-A", "FUSIS", "-s", "10.0.0.4", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.2", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.3", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.4", "-j", "MARK", "--set-mark", "9"},
 	}...))
 }
+
+func (s *S) TestIPTablesLockRetry(c *check.C) {
+	oldBackoff := xtablesBackoff
+	defer func() { xtablesBackoff = oldBackoff }()
+	xtablesBackoff = time.Millisecond
+	s.executor.results = map[string]fakeResult{
+		"iptables -t mangle -w 5 -N FUSIS": {
+			data: []byte("Another app is currently holding the xtables lock. Stopped waiting after 5s."),
+			err:  errors.New("exit 4"),
+		},
+	}
+	table := ipTables{Table: "mangle"}
+	err := table.New(context.Background(), "-N", "FUSIS")
+	c.Assert(err, check.ErrorMatches, "exit 4")
+	c.Assert(s.executor.log, check.HasLen, xtablesRetries+1)
+	s.executor.log = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = table.New(ctx, "-N", "FUSIS")
+	c.Assert(err, check.ErrorMatches, "exit 4")
+	c.Assert(s.executor.log, check.HasLen, 1)
+}
+
+func (s *S) TestVerify(c *check.C) {
+	nat := newTestNAT(c)
+	drift, err := nat.Verify(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{"chain FUSIS missing"})
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:FUSIS - [0:0]
+-A PREROUTING -j FUSIS
+-A FUSIS -s 10.0.0.1/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.3/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.4/32 -j ACCEPT
+COMMIT
+`)},
+	}
+	drift, err = nat.Verify(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{
+		"stale rule -s 10.0.0.3/32 -j MARK --set-xmark 0x9/0xffffffff",
+		"unexpected rule -s 10.0.0.4/32 -j ACCEPT",
+	})
+	drift, err = nat.Verify(context.Background(), testBackends("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{
+		"missing rule for 10.0.0.2",
+		"unexpected rule -s 10.0.0.4/32 -j ACCEPT",
+	})
+	for _, cmd := range s.executor.log {
+		c.Assert(cmd[0], check.Equals, "iptables-save")
+	}
+}
+
+func (s *S) TestNewNATApplier(c *check.C) {
+	_, err := NewNATApplier(NATOptions{})
+	c.Assert(err, check.ErrorMatches, "router is mandatory")
+	_, err = NewNATApplier(NATOptions{Router: "fusis"})
+	c.Assert(err, check.ErrorMatches, `invalid router address "fusis"`)
+	_, err = NewNATApplier(NATOptions{Router: "192.168.1.1", Mark: "x"})
+	c.Assert(err, check.ErrorMatches, `invalid mark "x"`)
+	_, err = NewNATApplier(NATOptions{Router: "192.168.1.1", RulePriority: 32766})
+	c.Assert(err, check.ErrorMatches, `invalid rule priority 32766`)
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(nat.Options(), check.DeepEquals, NATOptions{
+		Router:       "192.168.1.1",
+		TableID:      DefaultTableID,
+		TableName:    DefaultTableName,
+		RulePriority: DefaultRulePriority,
+		Chain:        DefaultChain,
+		Mark:         DefaultMark,
+		Sysctl:       SysctlIgnore,
+	})
+}
+
+func (s *S) TestNATApplierOptions(c *check.C) {
+	exec := &fakeExecutor{}
+	nat, err := NewNATApplier(NATOptions{
+		Router:       "192.168.1.1",
+		TableID:      200,
+		TableName:    "other.out",
+		Chain:        "OTHER",
+		TableDropIn:  true,
+		Mark:         "0x20",
+		Executor:     exec,
+		NetNamespace: "/var/run/netns/other",
+	})
+	c.Assert(err, check.IsNil)
+	err = nat.Apply(context.Background(), []Backend{{IP: "10.0.0.1", Router: "192.168.1.1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.IsNil)
+	nsenter := []string{"nsenter", "--net=/var/run/netns/other", "--"}
+	var expected [][]string
+	for _, cmd := range [][]string{
+		{"ip", "route", "add", "default", "via", "192.168.1.1", "table", "200"},
+		{"ip", "rule", "list"},
+		{"ip", "rule", "add", "pref", "32765", "fwmark", "0x20", "table", "200"},
+		{"iptables-save", "-t", "mangle"},
+		{"iptables", "-t", "mangle", "-w", "5", "-N", "OTHER"},
+		{"iptables", "-t", "mangle", "-w", "5", "-I", "PREROUTING", "-j", "OTHER"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "OTHER", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "0x20"},
+	} {
+		expected = append(expected, append(nsenter, cmd...))
+	}
+	c.Assert(exec.log, check.DeepEquals, expected)
+	data, err := ioutil.ReadFile(filepath.Join(s.tempdir, "rt_tables.d", "other.out.conf"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "# Managed by fusis-agent\n200 other.out\n")
+	err = nat.Apply(context.Background(), []Backend{{IP: "10.0.0.1", Router: "192.168.1.2"}})
+	c.Assert(err, check.ErrorMatches, "backend 10.0.0.1 uses router 192.168.1.2, only 192.168.1.1 is supported")
+}
+
+func (s *S) TestApplyRuleComments(c *check.C) {
+	nat := newTestNAT(c)
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:FUSIS - [0:0]
+-A PREROUTING -j FUSIS
+-A FUSIS -s 10.0.0.1/32 -m comment --comment c1 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.2/32 -m comment --comment old -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.3/32 -j MARK --set-xmark 0x9/0xffffffff
+COMMIT
+`)},
+		"iptables -t mangle -w 5 -A FUSIS -s 10.0.0.3 -m comment --comment c3 -j MARK --set-mark 9": {
+			data: []byte("iptables: Other err."), err: errors.New("exit 1"),
+		},
+	}
+	backends := []Backend{
+		{IP: "10.0.0.1", ContainerID: "c1", Name: "web-1"},
+		{IP: "10.0.0.2", ContainerID: "c2", Name: "web-2"},
+		{IP: "10.0.0.3", ContainerID: "c3", Name: "web-3", Network: "bridge"},
+	}
+	drift, err := nat.Verify(context.Background(), backends)
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{
+		"missing rule for 10.0.0.2 (web-2, container c2)",
+		"missing rule for 10.0.0.3 (web-3, container c3, network bridge)",
+		"outdated rule -s 10.0.0.2/32 -m comment --comment old -j MARK --set-xmark 0x9/0xffffffff",
+		"outdated rule -s 10.0.0.3/32 -j MARK --set-xmark 0x9/0xffffffff",
+	})
+	err = nat.Apply(context.Background(), backends)
+	c.Assert(err, check.ErrorMatches, `multiple errors: error adding rule for 10\.0\.0\.3 \(web-3, container c3, network bridge\): exit 1`)
+	c.Assert(s.executor.log[len(s.executor.log)-4:], check.DeepEquals, [][]string{
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.2", "-m", "comment", "--comment", "c2", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.3", "-m", "comment", "--comment", "c3", "-j", "MARK", "--set-mark", "9"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.2/32", "-m", "comment", "--comment", "old", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "FUSIS", "-s", "10.0.0.3/32", "-j", "MARK", "--set-xmark", "0x9/0xffffffff"},
+	})
+}
+
+func (s *S) TestApplyFlushConntrack(c *check.C) {
+	var flushedIPs []string
+	oldFlush := conntrackFlush
+	defer func() { conntrackFlush = oldFlush }()
+	conntrackFlush = func(ctx context.Context, netns string, ips []string) (int, error) {
+		c.Assert(netns, check.Equals, "")
+		flushedIPs = append(flushedIPs, ips...)
+		return 3, nil
+	}
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:FUSIS - [0:0]
+-A PREROUTING -j FUSIS
+-A FUSIS -s 10.0.0.1/32 -m comment --comment old -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.2/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.3/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS -s 10.0.0.4/32 -j ACCEPT
+COMMIT
+`)},
+		"iptables -t mangle -w 5 -D FUSIS -s 10.0.0.3/32 -j MARK --set-xmark 0x9/0xffffffff": {
+			data: []byte("iptables: Other err."), err: errors.New("exit 1"),
+		},
+	}
+	backends := []Backend{{IP: "10.0.0.1", ContainerID: "c1"}}
+	nat := newTestNAT(c)
+	err := nat.Apply(context.Background(), backends)
+	c.Assert(err, check.ErrorMatches, `multiple errors: error removing rule .*10\.0\.0\.3.*`)
+	c.Assert(flushedIPs, check.IsNil)
+	nat, err = NewNATApplier(NATOptions{Router: "192.168.1.1", FlushConntrack: true})
+	c.Assert(err, check.IsNil)
+	before := metricValue("conntrack_flushed")
+	err = nat.Apply(context.Background(), backends)
+	c.Assert(err, check.NotNil)
+	c.Assert(flushedIPs, check.DeepEquals, []string{"10.0.0.2"})
+	c.Assert(metricValue("conntrack_flushed")-before, check.Equals, int64(3))
+	conntrackFlush = func(ctx context.Context, netns string, ips []string) (int, error) {
+		return 0, errors.New("operation not permitted")
+	}
+	delete(s.executor.results, "iptables -t mangle -w 5 -D FUSIS -s 10.0.0.3/32 -j MARK --set-xmark 0x9/0xffffffff")
+	err = nat.Apply(context.Background(), backends)
+	c.Assert(err, check.ErrorMatches, `multiple errors: error flushing conntrack entries: operation not permitted`)
+}
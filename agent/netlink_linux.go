@@ -0,0 +1,185 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	rtmgrpIPv4Route = 0x40
+	rtmgrpIPv4Rule  = 0x80
+	// rtaTable is the attribute with the full table id, both in routes
+	// (RTA_TABLE) and rules (FRA_TABLE), when it doesn't fit the header.
+	rtaTable = 15
+	// rtMsgTableOffset is the offset of the table field in both struct rtmsg
+	// and struct fib_rule_hdr.
+	rtMsgTableOffset = 4
+)
+
+// watchRoutingTable calls fn whenever a rule or route pointing to table is
+// deleted in the network namespace at netns, or in the current one if netns
+// is empty, until stop is closed.
+func watchRoutingTable(netns string, table uint32, stop <-chan struct{}, fn func(reason string)) error {
+	fd, err := netlinkSocket(netns, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4Route | rtmgrpIPv4Rule,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return os.NewSyscallError("bind", err)
+	}
+	// As with inotify, reads are made through a pollFile, so Close interrupts
+	// a pending one.
+	file, err := newPollFile(fd)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			file.Close()
+		case <-done:
+		}
+	}()
+	buf := make([]byte, os.Getpagesize()*4)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if sysErr, ok := err.(*os.SyscallError); ok && sysErr.Err == syscall.ENOBUFS {
+				// Notifications were dropped, some may have been ours.
+				fn("netlink notifications lost")
+				continue
+			}
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if reason, ok := routingTableEvent(&msg, table); ok {
+				fn(reason)
+			}
+		}
+	}
+}
+
+// routingTableEvent returns a description of msg if it's the deletion of a
+// rule or route pointing to table.
+func routingTableEvent(msg *syscall.NetlinkMessage, table uint32) (string, bool) {
+	var kind string
+	switch msg.Header.Type {
+	case syscall.RTM_DELRULE:
+		kind = "rule"
+	case syscall.RTM_DELROUTE:
+		kind = "route"
+	default:
+		return "", false
+	}
+	if len(msg.Data) < syscall.SizeofRtMsg {
+		return "", false
+	}
+	msgTable := uint32(msg.Data[rtMsgTableOffset])
+	attrs := msg.Data[syscall.SizeofRtMsg:]
+	for len(attrs) >= syscall.SizeofRtAttr {
+		attr := (*syscall.RtAttr)(unsafe.Pointer(&attrs[0]))
+		if int(attr.Len) < syscall.SizeofRtAttr || int(attr.Len) > len(attrs) {
+			break
+		}
+		if attr.Type == rtaTable && attr.Len >= syscall.SizeofRtAttr+4 {
+			msgTable = *(*uint32)(unsafe.Pointer(&attrs[syscall.SizeofRtAttr]))
+		}
+		attrs = attrs[rtaAlign(int(attr.Len)):]
+	}
+	if msgTable != table {
+		return "", false
+	}
+	return fmt.Sprintf("%s for table %d deleted", kind, table), true
+}
+
+func rtaAlign(length int) int {
+	return (length + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+}
+
+// netlinkSocket opens a non-blocking netlink socket of the given protocol in
+// the network namespace at netns. The socket keeps referring to the namespace
+// where it was created, so the thread only switches namespaces while creating
+// it.
+func netlinkSocket(netns string, proto int) (int, error) {
+	if netns == "" {
+		fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, proto)
+		if err != nil {
+			return -1, os.NewSyscallError("socket", err)
+		}
+		return fd, nil
+	}
+	type result struct {
+		fd  int
+		err error
+	}
+	results := make(chan result, 1)
+	// The namespace is switched by a goroutine locked to its thread. If it
+	// can't switch back the goroutine never exits, so the thread isn't reused
+	// in the wrong namespace: before Go 1.10 a thread still locked when its
+	// goroutine exits goes back to the pool.
+	go func() {
+		runtime.LockOSThread()
+		fd, restored, err := netlinkSocketIn(netns, proto)
+		results <- result{fd: fd, err: err}
+		if !restored {
+			select {}
+		}
+		runtime.UnlockOSThread()
+	}()
+	res := <-results
+	return res.fd, res.err
+}
+
+// netlinkSocketIn creates the socket switching the current thread to the
+// network namespace at netns, returning whether the thread is back to its
+// original namespace.
+func netlinkSocketIn(netns string, proto int) (int, bool, error) {
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		return -1, true, err
+	}
+	defer origin.Close()
+	target, err := os.Open(netns)
+	if err != nil {
+		return -1, true, err
+	}
+	defer target.Close()
+	err = unix.Setns(int(target.Fd()), syscall.CLONE_NEWNET)
+	if err != nil {
+		return -1, true, os.NewSyscallError("setns", err)
+	}
+	fd, sockErr := netlinkSocket("", proto)
+	err = unix.Setns(int(origin.Fd()), syscall.CLONE_NEWNET)
+	if err != nil {
+		if sockErr == nil {
+			syscall.Close(fd)
+		}
+		return -1, false, os.NewSyscallError("setns", err)
+	}
+	return fd, true, sockErr
+}
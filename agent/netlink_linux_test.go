@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"gopkg.in/check.v1"
+)
+
+func netlinkRouteMessage(msgType uint16, table uint8, attrTable uint32) *syscall.NetlinkMessage {
+	data := make([]byte, syscall.SizeofRtMsg)
+	data[rtMsgTableOffset] = table
+	if attrTable != 0 {
+		attr := make([]byte, syscall.SizeofRtAttr+4)
+		*(*syscall.RtAttr)(unsafe.Pointer(&attr[0])) = syscall.RtAttr{Len: uint16(len(attr)), Type: rtaTable}
+		*(*uint32)(unsafe.Pointer(&attr[syscall.SizeofRtAttr])) = attrTable
+		data = append(data, attr...)
+	}
+	return &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: msgType},
+		Data:   data,
+	}
+}
+
+func (s *S) TestRoutingTableEvent(c *check.C) {
+	reason, ok := routingTableEvent(netlinkRouteMessage(syscall.RTM_DELRULE, 100, 0), 100)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(reason, check.Equals, "rule for table 100 deleted")
+	reason, ok = routingTableEvent(netlinkRouteMessage(syscall.RTM_DELROUTE, 252, 1000), 1000)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(reason, check.Equals, "route for table 1000 deleted")
+	_, ok = routingTableEvent(netlinkRouteMessage(syscall.RTM_DELROUTE, 254, 0), 100)
+	c.Assert(ok, check.Equals, false)
+	_, ok = routingTableEvent(netlinkRouteMessage(syscall.RTM_NEWRULE, 100, 0), 100)
+	c.Assert(ok, check.Equals, false)
+	_, ok = routingTableEvent(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: syscall.RTM_DELRULE}}, 100)
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *RealS) TestWatchRoutingTable(c *check.C) {
+	stop := make(chan struct{})
+	reasons := make(chan string, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- watchRoutingTable("/var/run/netns/"+testNetNamespace, DefaultTableID, stop, func(reason string) {
+			reasons <- reason
+		})
+	}()
+	// The watch may not be subscribed yet, the rule is removed until it's
+	// noticed.
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		_, err := pkgExecutor.Exec(context.Background(), "ip", "rule", "add", "fwmark", DefaultMark, "table", "100")
+		c.Assert(err, check.IsNil)
+		_, err = pkgExecutor.Exec(context.Background(), "ip", "rule", "del", "fwmark", DefaultMark, "table", "100")
+		c.Assert(err, check.IsNil)
+		select {
+		case reason := <-reasons:
+			c.Assert(reason, check.Equals, "rule for table 100 deleted")
+			done = true
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			c.Fatal("timeout waiting for netlink notification")
+		}
+	}
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
+
+func (s *RealS) TestWatchDriftIgnoresOwnChanges(c *check.C) {
+	defer func(orig time.Duration) { ownChangeDelay = orig }(ownChangeDelay)
+	ownChangeDelay = 100 * time.Millisecond
+	// Commands are run, and drift watched, in the test namespace.
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Executor: DirectExecutor{}, NetNamespace: "/var/run/netns/" + testNetNamespace})
+	c.Assert(err, check.IsNil)
+	stop := make(chan struct{})
+	reasons := make(chan string, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- nat.WatchDrift(stop, func(reason string) {
+			reasons <- reason
+		})
+	}()
+	removeRule := func(mark string) {
+		_, err := pkgExecutor.Exec(context.Background(), "ip", "rule", "add", "fwmark", mark, "table", "100")
+		c.Assert(err, check.IsNil)
+		_, err = pkgExecutor.Exec(context.Background(), "ip", "rule", "del", "fwmark", mark, "table", "100")
+		c.Assert(err, check.IsNil)
+	}
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		removeRule(DefaultMark)
+		select {
+		case <-reasons:
+			done = true
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			c.Fatal("timeout waiting for netlink notification")
+		}
+	}
+	// The rule of a previous mark is removed by the applier itself.
+	_, err = pkgExecutor.Exec(context.Background(), "ip", "rule", "add", "fwmark", "7", "table", "100")
+	c.Assert(err, check.IsNil)
+	err = nat.Cleanup(context.Background(), &State{Mark: "7", TableID: DefaultTableID})
+	c.Assert(err, check.IsNil)
+	time.Sleep(2 * ownChangeDelay)
+	select {
+	case reason := <-reasons:
+		c.Fatalf("unexpected drift: %s", reason)
+	default:
+	}
+	removeRule(DefaultMark)
+	select {
+	case reason := <-reasons:
+		c.Assert(reason, check.Equals, "rule for table 100 deleted")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for netlink notification")
+	}
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+// watchRoutingTable only waits for stop on platforms without netlink, drift is
+// detected by the periodic verification alone.
+func watchRoutingTable(netns string, table uint32, stop <-chan struct{}, fn func(reason string)) error {
+	<-stop
+	return nil
+}
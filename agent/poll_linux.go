@@ -0,0 +1,142 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// errPollClosed is returned by reads on a closed pollFile, including the ones
+// interrupted by Close.
+var errPollClosed = errors.New("use of closed file")
+
+// pollFile reads and writes a non-blocking descriptor, waiting for it with
+// epoll along with a pipe written by Close. The runtime poller only handles
+// such descriptors, allowing Close to interrupt a pending Read, since Go 1.12.
+type pollFile struct {
+	fd   int
+	epfd int
+	wake [2]int
+
+	// mu is held by reads and writes, Close waits for them after waking them
+	// up.
+	mu        sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+// newPollFile returns a pollFile owning fd, which must be non-blocking. The
+// descriptor is closed by Close, or right away if an error is returned.
+func newPollFile(fd int) (*pollFile, error) {
+	f := &pollFile{fd: fd, epfd: -1, wake: [2]int{-1, -1}}
+	err := f.init()
+	if err != nil {
+		f.closeFds()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *pollFile) init() error {
+	var err error
+	f.epfd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("epoll_create1", err)
+	}
+	var wake [2]int
+	err = unix.Pipe2(wake[:], unix.O_CLOEXEC|unix.O_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("pipe2", err)
+	}
+	f.wake = wake
+	for _, fd := range []int{f.fd, f.wake[0]} {
+		ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+		err = unix.EpollCtl(f.epfd, unix.EPOLL_CTL_ADD, fd, &ev)
+		if err != nil {
+			return os.NewSyscallError("epoll_ctl", err)
+		}
+	}
+	return nil
+}
+
+// Read reads from the descriptor, waiting until it's readable or the file is
+// closed.
+func (f *pollFile) Read(buf []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events := make([]unix.EpollEvent, 2)
+	for {
+		if f.closed {
+			return 0, errPollClosed
+		}
+		n, err := syscall.Read(f.fd, buf)
+		if err == nil {
+			return n, nil
+		}
+		if err != syscall.EAGAIN && err != syscall.EINTR {
+			return 0, os.NewSyscallError("read", err)
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		ready, err := unix.EpollWait(f.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, os.NewSyscallError("epoll_wait", err)
+		}
+		for _, ev := range events[:ready] {
+			if int(ev.Fd) == f.wake[0] {
+				return 0, errPollClosed
+			}
+		}
+	}
+}
+
+// Write writes buf to the descriptor, which is expected not to block, as
+// with netlink requests.
+func (f *pollFile) Write(buf []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errPollClosed
+	}
+	for {
+		n, err := syscall.Write(f.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, os.NewSyscallError("write", err)
+		}
+		return n, nil
+	}
+}
+
+// Close interrupts a pending Read and closes the descriptor. It's safe to be
+// called concurrently and more than once.
+func (f *pollFile) Close() error {
+	f.closeOnce.Do(func() {
+		syscall.Write(f.wake[1], []byte{0})
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.closed = true
+		f.closeFds()
+	})
+	return nil
+}
+
+func (f *pollFile) closeFds() {
+	for _, fd := range []int{f.fd, f.epfd, f.wake[0], f.wake[1]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
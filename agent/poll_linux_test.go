@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"syscall"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestPollFile(c *check.C) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	c.Assert(err, check.IsNil)
+	defer syscall.Close(fds[1])
+	file, err := newPollFile(fds[0])
+	c.Assert(err, check.IsNil)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		syscall.Write(fds[1], []byte("ping"))
+	}()
+	buf := make([]byte, 16)
+	n, err := file.Read(buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buf[:n]), check.Equals, "ping")
+	_, err = file.Write([]byte("pong"))
+	c.Assert(err, check.IsNil)
+	n, err = syscall.Read(fds[1], buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buf[:n]), check.Equals, "pong")
+	// Close interrupts a read waiting for data.
+	errCh := make(chan error)
+	go func() {
+		_, err := file.Read(buf)
+		errCh <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(file.Close(), check.IsNil)
+	select {
+	case err = <-errCh:
+		c.Assert(err, check.Equals, errPollClosed)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for read to be interrupted")
+	}
+	c.Assert(file.Close(), check.IsNil)
+	_, err = file.Read(buf)
+	c.Assert(err, check.Equals, errPollClosed)
+}
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// rtTablesDirs are the directories where iproute2 looks up table names,
+	// in rt_tables and in the *.conf files under rt_tables.d. The drop-in
+	// naming the applier table is written in the first one.
+	rtTablesDirs = []string{"/etc/iproute2", "/usr/share/iproute2"}
+)
+
+// legacyTableEntry is the table name appended to rt_tables by versions
+// before table names were written as drop-ins, without any state recording
+// it.
+const legacyTableEntry = "100 fusis.out"
+
+// reservedTables are the IDs used by the kernel, which can't be used by the
+// applier.
+var reservedTables = map[int]string{
+	0:   "unspec",
+	253: "default",
+	254: "main",
+	255: "local",
+}
+
+// rtTableEntry is a table name defined in an iproute2 file.
+type rtTableEntry struct {
+	ID   int
+	Name string
+	Path string
+}
+
+// parseRTTables parses a file with a table per line, as in "100 fusis.out",
+// ignoring comments and invalid lines as iproute2 does.
+func parseRTTables(path string, data []byte) []rtTableEntry {
+	var entries []rtTableEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, rtTableEntry{ID: int(id), Name: fields[1], Path: path})
+	}
+	return entries
+}
+
+// rtTablesFiles returns the files where iproute2 looks up table names, the
+// ones which don't exist are skipped.
+func rtTablesFiles() []string {
+	var paths []string
+	for _, dir := range rtTablesDirs {
+		paths = append(paths, filepath.Join(dir, "rt_tables"))
+		dropIns, _ := filepath.Glob(filepath.Join(dir, "rt_tables.d", "*.conf"))
+		sort.Strings(dropIns)
+		paths = append(paths, dropIns...)
+	}
+	return paths
+}
+
+// tableFile returns the drop-in naming the applier table, empty if it's
+// not written.
+func (a *NATApplier) tableFile() string {
+	if !a.opts.TableDropIn || len(rtTablesDirs) == 0 {
+		return ""
+	}
+	return filepath.Join(rtTablesDirs[0], "rt_tables.d", a.opts.TableName+".conf")
+}
+
+// table returns the table ID as used in ip commands, which don't depend on
+// its name being defined.
+func (a *NATApplier) table() string {
+	return strconv.Itoa(a.opts.TableID)
+}
+
+// checkTableNames looks for other tables using the applier table ID or
+// name, returning a description of each conflict found. Without conflicts
+// the drop-in naming the table is written, if enabled.
+func (a *NATApplier) checkTableNames() ([]string, error) {
+	a.mu.Lock()
+	legacyChecked := a.legacyChecked
+	a.legacyChecked = true
+	a.mu.Unlock()
+	if !legacyChecked {
+		err := removeRTTablesEntry(legacyTableEntry)
+		if err != nil {
+			log.Printf("unable to remove table name %s: %s", legacyTableEntry, err)
+		}
+	}
+	own := a.tableFile()
+	var conflicts []string
+	for _, path := range rtTablesFiles() {
+		if path == own {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("unable to read table names: %s", err)
+			}
+			continue
+		}
+		for _, e := range parseRTTables(path, data) {
+			switch {
+			case e.ID == a.opts.TableID && e.Name != a.opts.TableName:
+				conflicts = append(conflicts, fmt.Sprintf("table %d is named %s in %s, not %s", e.ID, e.Name, e.Path, a.opts.TableName))
+			case e.ID != a.opts.TableID && e.Name == a.opts.TableName:
+				conflicts = append(conflicts, fmt.Sprintf("table name %s is used by table %d in %s, not %d", e.Name, e.ID, e.Path, a.opts.TableID))
+			}
+		}
+	}
+	if own == "" || len(conflicts) > 0 {
+		return conflicts, nil
+	}
+	data := []byte(fmt.Sprintf("# Managed by fusis-agent\n%d %s\n", a.opts.TableID, a.opts.TableName))
+	current, err := ioutil.ReadFile(own)
+	if err == nil && bytes.Equal(current, data) {
+		return nil, nil
+	}
+	return nil, writeFile(own, data, 0644)
+}
+
+// cleanupTableName removes the table name left by a previous configuration,
+// described by old, if it's not used anymore. States without a drop-in had
+// the name appended to rt_tables, where it's removed from.
+func (a *NATApplier) cleanupTableName(old *State) error {
+	if old.TableFile != "" {
+		if old.TableFile == a.tableFile() {
+			return nil
+		}
+		err := os.Remove(old.TableFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if old.TableName == "" {
+		return nil
+	}
+	return removeRTTablesEntry(fmt.Sprintf("%d %s", old.TableID, old.TableName))
+}
+
+// removeRTTablesEntry removes the lines defining exactly entry, as in
+// "100 fusis.out", from the rt_tables file where iproute2 looks up table
+// names first.
+func removeRTTablesEntry(entry string) error {
+	if len(rtTablesDirs) == 0 {
+		return nil
+	}
+	path := filepath.Join(rtTablesDirs[0], "rt_tables")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.Join(strings.Fields(line), " ") != entry {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return nil
+	}
+	log.Printf("removing table %s from %s", entry, path)
+	// Written in place, the file may be a bind mount which can't be replaced.
+	return ioutil.WriteFile(path, []byte(strings.Join(kept, "\n")), 0644)
+}
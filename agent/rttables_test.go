@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseRTTables(c *check.C) {
+	entries := parseRTTables("rt_tables", []byte(`#
+# reserved values
+#
+255	local
+254	main # the main table
+0x64 fusis.out
+invalid line
+`))
+	c.Assert(entries, check.DeepEquals, []rtTableEntry{
+		{ID: 255, Name: "local", Path: "rt_tables"},
+		{ID: 254, Name: "main", Path: "rt_tables"},
+		{ID: 100, Name: "fusis.out", Path: "rt_tables"},
+	})
+}
+
+func (s *S) TestNewNATApplierReservedTable(c *check.C) {
+	_, err := NewNATApplier(NATOptions{Router: "192.168.1.1", TableID: 254})
+	c.Assert(err, check.ErrorMatches, `invalid table ID 254`)
+	_, err = NewNATApplier(NATOptions{Router: "192.168.1.1", TableID: -1})
+	c.Assert(err, check.ErrorMatches, `invalid table ID -1`)
+}
+
+func (s *S) TestCheckTableNames(c *check.C) {
+	other := filepath.Join(s.tempdir, "other")
+	rtTablesDirs = append(rtTablesDirs, other)
+	err := os.MkdirAll(filepath.Join(other, "rt_tables.d"), 0755)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(other, "rt_tables"), []byte("255 local\n100 fusis.out\n"), 0644)
+	c.Assert(err, check.IsNil)
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", TableDropIn: true})
+	c.Assert(err, check.IsNil)
+	conflicts, err := nat.checkTableNames()
+	c.Assert(err, check.IsNil)
+	c.Assert(conflicts, check.IsNil)
+	dropIn := filepath.Join(s.tempdir, "rt_tables.d", "fusis.out.conf")
+	data, err := ioutil.ReadFile(dropIn)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "# Managed by fusis-agent\n100 fusis.out\n")
+	var state State
+	nat.describe(&state)
+	c.Assert(state.TableName, check.Equals, "fusis.out")
+	c.Assert(state.TableFile, check.Equals, dropIn)
+	conflictsFile := filepath.Join(other, "rt_tables.d", "vpn.conf")
+	err = ioutil.WriteFile(conflictsFile, []byte("100 vpn\n200 fusis.out\n"), 0644)
+	c.Assert(err, check.IsNil)
+	err = os.Remove(dropIn)
+	c.Assert(err, check.IsNil)
+	conflicts, err = nat.checkTableNames()
+	c.Assert(err, check.IsNil)
+	c.Assert(conflicts, check.DeepEquals, []string{
+		"table 100 is named vpn in " + conflictsFile + ", not fusis.out",
+		"table name fusis.out is used by table 200 in " + conflictsFile + ", not 100",
+	})
+	_, err = os.Stat(dropIn)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestCleanupTableDropIn(c *check.C) {
+	old := filepath.Join(s.tempdir, "rt_tables.d", "old.out.conf")
+	err := writeFile(old, []byte("200 old.out\n"), 0644)
+	c.Assert(err, check.IsNil)
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1"})
+	c.Assert(err, check.IsNil)
+	err = nat.Cleanup(context.Background(), &State{TableID: 200, TableName: "old.out", TableFile: old})
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(old)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	c.Assert(s.executor.log, check.DeepEquals, [][]string{
+		{"ip", "route", "flush", "table", "200"},
+	})
+}
+
+func (s *S) TestApplyRemovesLegacyTableName(c *check.C) {
+	// As left by versions appending the table name, which saved no state.
+	rtTables := filepath.Join(s.tempdir, "rt_tables")
+	err := ioutil.WriteFile(rtTables, []byte("255\tlocal\n254\tmain\n200 vpn\n\n100 fusis.out\n"), 0644)
+	c.Assert(err, check.IsNil)
+	nat := newTestNAT(c)
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(rtTables)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "255\tlocal\n254\tmain\n200 vpn\n\n")
+	c.Assert(nat.Problems(), check.IsNil)
+	// Only checked once, a name added back later by the user is kept.
+	err = ioutil.WriteFile(rtTables, []byte("100 fusis.out\n"), 0644)
+	c.Assert(err, check.IsNil)
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	data, err = ioutil.ReadFile(rtTables)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "100 fusis.out\n")
+}
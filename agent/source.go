@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Workload is a unit running on the host, usually a container, whose traffic
+// must be routed through fusis.
+type Workload struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+	IPs    []string
+	// Network is the name of the network the addresses belong to, if the
+	// runtime has such a concept.
+	Network string
+	// HostPorts are the ports, as in "80/tcp", served by a workload using
+	// the host network, which has no address of its own. Its responses are
+	// identified by their source port.
+	HostPorts []string
+	// Cgroup is the cgroup v2 path, as in "/system.slice/docker-0123.scope",
+	// of a workload using the host network, matching its packets instead of
+	// HostPorts when set. Pid is the process it was resolved from.
+	Cgroup string
+	Pid    int
+	// Health is the status of the workload healthcheck, "starting",
+	// "healthy" or "unhealthy", empty if it has none or the runtime doesn't
+	// report it.
+	Health string
+}
+
+// parsePorts parses a comma separated list of ports, as in "80,53/udp",
+// returning them with their protocol, tcp if not set.
+func parsePorts(value string) ([]string, error) {
+	var ports []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		parts := strings.SplitN(part, "/", 2)
+		proto := "tcp"
+		if len(parts) == 2 {
+			proto = strings.ToLower(parts[1])
+		}
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port <= 0 || port > 65535 || (proto != "tcp" && proto != "udp") {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		ports = append(ports, fmt.Sprintf("%d/%s", port, proto))
+	}
+	return ports, nil
+}
+
+// ContainerSource is implemented by container runtimes able to list running
+// workloads matching a label filter.
+type ContainerSource interface {
+	// List returns the running workloads matching the label filter.
+	List(ctx context.Context) ([]Workload, error)
+	// Watch blocks until stop is closed, sending on changes whenever the
+	// result of List may have changed.
+	Watch(changes chan<- struct{}, stop <-chan struct{}) error
+}
+
+// parseLabelFilter splits a label filter in the docker format, either "key"
+// or "key=value", into its key and value.
+func parseLabelFilter(filter string) (string, string, error) {
+	parts := strings.SplitN(filter, "=", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("invalid label filter %q", filter)
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+// multiSource combines several sources, listing the union of their workloads.
+type multiSource []ContainerSource
+
+var _ ContainerSource = multiSource{}
+
+func (m multiSource) List(ctx context.Context) ([]Workload, error) {
+	var all []Workload
+	for _, src := range m {
+		workloads, err := src.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing workloads using %T: %s", src, err)
+		}
+		all = append(all, workloads...)
+	}
+	return all, nil
+}
+
+// Watch watches all sources, returning as soon as any of them fails so the
+// whole watch can be restarted.
+func (m multiSource) Watch(changes chan<- struct{}, stop <-chan struct{}) error {
+	innerStop := make(chan struct{})
+	errCh := make(chan error, len(m))
+	for _, src := range m {
+		go func(src ContainerSource) {
+			err := src.Watch(changes, innerStop)
+			if err != nil {
+				err = fmt.Errorf("error watching changes using %T: %s", src, err)
+			}
+			errCh <- err
+		}(src)
+	}
+	var err error
+	received := 0
+	select {
+	case <-stop:
+	case err = <-errCh:
+		received++
+	}
+	close(innerStop)
+	for ; received < len(m); received++ {
+		<-errCh
+	}
+	return err
+}
+
+// stopContext returns a context canceled when stop is closed, the returned
+// cancel function must be called to release its resources.
+func stopContext(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func notifyChange(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
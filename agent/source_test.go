@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"errors"
+
+	"gopkg.in/check.v1"
+)
+
+type fakeSource struct {
+	workloads []Workload
+	err       error
+	watchErr  error
+	watching  chan struct{}
+}
+
+func (f *fakeSource) List(ctx context.Context) ([]Workload, error) {
+	return f.workloads, f.err
+}
+
+func (f *fakeSource) Watch(changes chan<- struct{}, stop <-chan struct{}) error {
+	if f.watching != nil {
+		f.watching <- struct{}{}
+	}
+	if f.watchErr != nil {
+		return f.watchErr
+	}
+	<-stop
+	return nil
+}
+
+func (s *S) TestParseLabelFilter(c *check.C) {
+	key, value, err := parseLabelFilter("router=fusis")
+	c.Assert(err, check.IsNil)
+	c.Assert(key, check.Equals, "router")
+	c.Assert(value, check.Equals, "fusis")
+	key, value, err = parseLabelFilter("router")
+	c.Assert(err, check.IsNil)
+	c.Assert(key, check.Equals, "router")
+	c.Assert(value, check.Equals, "")
+	_, _, err = parseLabelFilter("")
+	c.Assert(err, check.ErrorMatches, `invalid label filter ""`)
+}
+
+func (s *S) TestMultiSourceList(c *check.C) {
+	src := multiSource{
+		&fakeSource{workloads: []Workload{{ID: "c1", IPs: []string{"10.0.0.1"}}}},
+		&fakeSource{workloads: []Workload{{ID: "vm1", IPs: []string{"10.0.0.2"}}}},
+	}
+	workloads, err := src.List(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(workloads, check.DeepEquals, []Workload{
+		{ID: "c1", IPs: []string{"10.0.0.1"}},
+		{ID: "vm1", IPs: []string{"10.0.0.2"}},
+	})
+	src = append(src, &fakeSource{err: errors.New("my error")})
+	_, err = src.List(context.Background())
+	c.Assert(err, check.ErrorMatches, `error listing workloads using \*agent.fakeSource: my error`)
+}
+
+func (s *S) TestMultiSourceWatch(c *check.C) {
+	src := multiSource{
+		&fakeSource{},
+		&fakeSource{watchErr: errors.New("watch error")},
+	}
+	err := src.Watch(make(chan struct{}), make(chan struct{}))
+	c.Assert(err, check.ErrorMatches, `error watching changes using \*agent.fakeSource: watch error`)
+	watching := make(chan struct{}, 2)
+	src = multiSource{
+		&fakeSource{watching: watching},
+		&fakeSource{watching: watching},
+	}
+	stop := make(chan struct{})
+	errCh := make(chan error)
+	go func() {
+		errCh <- src.Watch(make(chan struct{}), stop)
+	}()
+	<-watching
+	<-watching
+	close(stop)
+	c.Assert(<-errCh, check.IsNil)
+}
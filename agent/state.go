@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// State is the desired state last applied by the agent, persisted so a new
+// agent process knows what it owns and which artifacts of a previous
+// configuration must be removed.
+type State struct {
+	Router  string `json:"router"`
+	Mark    string `json:"mark"`
+	TableID int    `json:"tableID"`
+	// TableName is the name defined for the table by TableFile, or by
+	// rt_tables in versions not writing drop-ins, empty if none.
+	TableName string `json:"tableName"`
+	TableFile string `json:"tableFile,omitempty"`
+	Chain     string `json:"chain"`
+	Tunnel    string `json:"tunnel,omitempty"`
+	// Sysctls are the original values of the kernel parameters set by the
+	// applier.
+	Sysctls   map[string]string `json:"sysctls,omitempty"`
+	Backends  []Backend         `json:"backends"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// Backend is an address whose traffic must be routed through a fusis
+// router, and the workload using it.
+type Backend struct {
+	IP          string            `json:"ip"`
+	ContainerID string            `json:"containerID,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Network     string            `json:"network,omitempty"`
+	// Port is the source port, as in "80/tcp", of a workload using the host
+	// network, which is marked instead of the address it shares with the
+	// host. IP is empty in this case.
+	Port string `json:"port,omitempty"`
+	// Cgroup is the cgroup v2 path of a workload using the host network,
+	// which is marked instead of its ports. Pid is the process it was
+	// resolved from, the cgroup is recreated when the container restarts.
+	Cgroup string `json:"cgroup,omitempty"`
+	Pid    int    `json:"pid,omitempty"`
+	// Router is the fusis router address, an applier may use its own when
+	// empty.
+	Router string `json:"router,omitempty"`
+}
+
+// target returns what identifies the traffic of the backend, its address,
+// source port or cgroup.
+func (b Backend) target() string {
+	if b.Cgroup != "" {
+		return "cgroup " + b.Cgroup
+	}
+	if b.Port != "" {
+		return "port " + b.Port
+	}
+	return b.IP
+}
+
+// String describes the backend by its address, or port, followed by the
+// workload using it, as in "10.0.0.1 (web, container 0123456789ab, network
+// bridge)".
+func (b Backend) String() string {
+	var details []string
+	if b.Name != "" {
+		details = append(details, b.Name)
+	}
+	if b.ContainerID != "" && b.ContainerID != b.IP {
+		id := b.ContainerID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		details = append(details, "container "+id)
+	}
+	if b.Network != "" {
+		details = append(details, "network "+b.Network)
+	}
+	if len(details) == 0 {
+		return b.target()
+	}
+	return fmt.Sprintf("%s (%s)", b.target(), strings.Join(details, ", "))
+}
+
+type backendsByIP []Backend
+
+func (l backendsByIP) Len() int      { return len(l) }
+func (l backendsByIP) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l backendsByIP) Less(i, j int) bool {
+	if l[i].IP != l[j].IP {
+		return l[i].IP < l[j].IP
+	}
+	if l[i].Port != l[j].Port {
+		return l[i].Port < l[j].Port
+	}
+	return l[i].Cgroup < l[j].Cgroup
+}
+
+// IPs returns the addresses of all backends in the state, backends marked
+// by port or cgroup are skipped.
+func (s *State) IPs() []string {
+	ips := make([]string, 0, len(s.Backends))
+	for _, b := range s.Backends {
+		if b.IP != "" {
+			ips = append(ips, b.IP)
+		}
+	}
+	return ips
+}
+
+// sameAs returns whether both states describe the same desired state,
+// regardless of when they were updated.
+func (s *State) sameAs(other *State) bool {
+	if other == nil || s.Router != other.Router || s.Mark != other.Mark || s.TableID != other.TableID ||
+		s.TableName != other.TableName || s.TableFile != other.TableFile || s.Chain != other.Chain ||
+		s.Tunnel != other.Tunnel ||
+		len(s.Backends) != len(other.Backends) || len(s.Sysctls) != len(other.Sysctls) {
+		return false
+	}
+	if len(s.Sysctls) > 0 && !reflect.DeepEqual(s.Sysctls, other.Sysctls) {
+		return false
+	}
+	return reflect.DeepEqual(s.Backends, other.Backends)
+}
+
+// ReadState reads the state persisted at path.
+func ReadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// writeState persists state at path, replacing the previous file atomically
+// so a crash never leaves a partially written state behind.
+func writeState(path string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), 0600)
+}
+
+// writeFile atomically replaces the file at path with data, creating its
+// directory if needed.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestWriteReadState(c *check.C) {
+	dir, err := ioutil.TempDir("", "state")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lib", "state.json")
+	state := &State{
+		Router:    "192.168.1.1",
+		Mark:      "9",
+		TableID:   100,
+		TableName: "fusis.out",
+		Chain:     "FUSIS",
+		Backends:  []Backend{{IP: "10.0.0.1", ContainerID: "c1", Name: "web"}},
+		UpdatedAt: time.Date(2016, 7, 1, 10, 0, 0, 0, time.UTC),
+	}
+	err = writeState(path, state)
+	c.Assert(err, check.IsNil)
+	read, err := ReadState(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(read, check.DeepEquals, state)
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 1)
+	read.UpdatedAt = time.Now()
+	c.Assert(read.sameAs(state), check.Equals, true)
+	read.Backends[0].ContainerID = "c2"
+	c.Assert(read.sameAs(state), check.Equals, false)
+	c.Assert(state.sameAs(nil), check.Equals, false)
+}
+
+func (s *S) TestAgentReconcileState(c *check.C) {
+	dir, err := ioutil.TempDir("", "state")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	err = writeState(path, &State{
+		Router:    "192.168.1.2",
+		Mark:      "7",
+		TableID:   100,
+		TableName: "fusis.out",
+		Chain:     "FUSIS_OLD",
+		Backends:  []Backend{{IP: "10.0.0.5"}},
+	})
+	c.Assert(err, check.IsNil)
+	rtTables := filepath.Join(s.tempdir, "rt_tables")
+	err = ioutil.WriteFile(rtTables, []byte("255\tlocal\n\n100 fusis.out\n"), 0644)
+	c.Assert(err, check.IsNil)
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte("*mangle\n:PREROUTING ACCEPT [0:0]\n:FUSIS_OLD - [0:0]\n-A PREROUTING -j FUSIS_OLD\nCOMMIT\n")},
+	}
+	a := Agent{
+		FusisAddress: "192.168.1.1",
+		StateFile:    path,
+		applier:      newTestNAT(c),
+		source: &fakeSource{workloads: []Workload{
+			{ID: "c2", Name: "web-2", IPs: []string{"10.0.0.2"}},
+			{ID: "c1", Name: "web-1", IPs: []string{"10.0.0.1", "10.0.0.2"}},
+		}},
+	}
+	a.restoreState(context.Background())
+	c.Assert(a.state.IPs(), check.DeepEquals, []string{"10.0.0.5"})
+	data, err := ioutil.ReadFile(rtTables)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "255\tlocal\n\n")
+	c.Assert(s.executor.log, check.DeepEquals, [][]string{
+		{"iptables-save", "-t", "mangle"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "PREROUTING", "-j", "FUSIS_OLD"},
+		{"iptables", "-t", "mangle", "-w", "5", "-F", "FUSIS_OLD"},
+		{"iptables", "-t", "mangle", "-w", "5", "-X", "FUSIS_OLD"},
+		{"iptables-save", "-t", "mangle"},
+		{"ip", "rule", "del", "fwmark", "7", "table", "100"},
+		{"ip", "route", "del", "default", "via", "192.168.1.2", "table", "100"},
+	})
+	a.reconcile(context.Background())
+	state, err := ReadState(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(state.UpdatedAt.IsZero(), check.Equals, false)
+	state.UpdatedAt = time.Time{}
+	c.Assert(state, check.DeepEquals, &State{
+		Router:  "192.168.1.1",
+		Mark:    "9",
+		TableID: 100,
+		Chain:   "FUSIS",
+		Backends: []Backend{
+			{IP: "10.0.0.1", ContainerID: "c1", Name: "web-1", Router: "192.168.1.1"},
+			{IP: "10.0.0.2", ContainerID: "c2", Name: "web-2", Router: "192.168.1.1"},
+		},
+	})
+	c.Assert(a.state.IPs(), check.DeepEquals, []string{"10.0.0.1", "10.0.0.2"})
+}
+
+func (s *S) TestBackendString(c *check.C) {
+	c.Assert(Backend{IP: "10.0.0.1"}.String(), check.Equals, "10.0.0.1")
+	c.Assert(Backend{IP: "10.0.0.1", ContainerID: "10.0.0.1"}.String(), check.Equals, "10.0.0.1")
+	c.Assert(Backend{
+		IP:          "10.0.0.1",
+		ContainerID: "0123456789abcdef0123456789abcdef",
+		Name:        "web",
+		Network:     "backend",
+	}.String(), check.Equals, "10.0.0.1 (web, container 0123456789ab, network backend)")
+	c.Assert(Backend{Port: "53/udp", Name: "dns", Network: "host"}.String(), check.Equals, "port 53/udp (dns, network host)")
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+var (
+	// reconcileBackoff is the delay before retrying the first failed
+	// reconcile, doubled on each consecutive failure up to Interval.
+	reconcileBackoff = time.Second
+)
+
+// Status describes the outcome of the reconciles made by the agent.
+type Status struct {
+	LastReconcile *time.Time `json:"lastReconcile,omitempty"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	// Failures is the number of consecutive failed reconciles, reset after a
+	// successful one.
+	Failures int `json:"failures"`
+	// Backoff is the delay before retrying a failed reconcile and NextRetry
+	// when the retry is due, both empty after a successful reconcile.
+	Backoff   string     `json:"backoff,omitempty"`
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+	// Backends are the ones applied by the last successful reconcile.
+	Backends []Backend `json:"backends"`
+	// Problems are host misconfigurations found by the last successful
+	// reconcile, which may break routing through the router.
+	Problems []string `json:"problems,omitempty"`
+	// Excluded are the workloads left out by the last reconcile for not
+	// being healthy, as in "web-1: unhealthy".
+	Excluded []string `json:"excluded,omitempty"`
+}
+
+// Status returns the current agent status, it's safe to be called while the
+// agent is running.
+func (a *Agent) Status() Status {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	return a.status
+}
+
+func (a *Agent) setStatusBackends(backends []Backend) {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	a.status.Backends = backends
+}
+
+// setStatusProblems updates the problems in the status, logging the ones not
+// found before.
+func (a *Agent) setStatusProblems(problems []string) {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	known := make(map[string]bool)
+	for _, p := range a.status.Problems {
+		known[p] = true
+	}
+	for _, p := range problems {
+		if !known[p] {
+			log.Printf("host misconfiguration: %s", p)
+		}
+	}
+	a.status.Problems = problems
+}
+
+// recordReconcile updates the status with the result of a reconcile,
+// returning how long to wait before the next one unless a change happens.
+func (a *Agent) recordReconcile(err error) time.Duration {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	now := time.Now().UTC()
+	a.status.LastReconcile = &now
+	if err == nil {
+		a.status.LastSuccess = &now
+		a.status.LastError = ""
+		a.status.Failures = 0
+		a.status.Backoff = ""
+		a.status.NextRetry = nil
+		return a.Interval
+	}
+	a.status.LastError = err.Error()
+	a.status.Failures++
+	metrics.Add("reconcile_failures", 1)
+	delay := retryBackoff(a.status.Failures, a.Interval)
+	next := now.Add(delay)
+	a.status.Backoff = delay.String()
+	a.status.NextRetry = &next
+	return delay
+}
+
+// retryBackoff returns the delay before retrying after the given number of
+// consecutive failures, growing exponentially up to max with jitter so
+// agents on many hosts don't retry in lockstep.
+func retryBackoff(failures int, max time.Duration) time.Duration {
+	delay := reconcileBackoff
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if delay <= 1 {
+		return delay
+	}
+	// Full delay minus up to half of it.
+	half := int64(delay / 2)
+	return delay - time.Duration(rand.Int63n(half+1))
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestRetryBackoff(c *check.C) {
+	tests := []struct {
+		failures int
+		max      time.Duration
+		expected time.Duration
+	}{
+		{1, time.Minute, time.Second},
+		{2, time.Minute, 2 * time.Second},
+		{4, time.Minute, 8 * time.Second},
+		{7, time.Minute, time.Minute},
+		{100, time.Minute, time.Minute},
+		{1, 100 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			delay := retryBackoff(tt.failures, tt.max)
+			c.Assert(delay <= tt.expected, check.Equals, true, check.Commentf("failures %d: %s", tt.failures, delay))
+			c.Assert(delay >= tt.expected/2, check.Equals, true, check.Commentf("failures %d: %s", tt.failures, delay))
+		}
+	}
+}
+
+type failingApplier struct {
+	Applier
+	err error
+}
+
+func (a *failingApplier) Apply(ctx context.Context, backends []Backend) error {
+	return a.err
+}
+
+func (s *S) TestAgentReconcileBackoff(c *check.C) {
+	applier := &failingApplier{Applier: newTestNAT(c), err: errors.New("my error")}
+	a := Agent{
+		FusisAddress: "192.168.1.1",
+		Interval:     time.Minute,
+		applier:      applier,
+		source:       &fakeSource{},
+	}
+	failures := metricValue("reconcile_failures")
+	delay := a.recordReconcile(a.reconcile(context.Background()))
+	c.Assert(delay <= time.Second, check.Equals, true)
+	delay = a.recordReconcile(a.reconcile(context.Background()))
+	c.Assert(delay > time.Second && delay <= 2*time.Second, check.Equals, true)
+	status := a.Status()
+	c.Assert(status.Failures, check.Equals, 2)
+	c.Assert(status.LastError, check.Equals, "error applying rules: my error")
+	c.Assert(status.Backoff, check.Equals, delay.String())
+	c.Assert(status.NextRetry, check.NotNil)
+	c.Assert(status.LastSuccess, check.IsNil)
+	c.Assert(metricValue("reconcile_failures"), check.Equals, failures+2)
+	applier.err = nil
+	delay = a.recordReconcile(a.reconcile(context.Background()))
+	c.Assert(delay, check.Equals, time.Minute)
+	status = a.Status()
+	c.Assert(status.Failures, check.Equals, 0)
+	c.Assert(status.LastError, check.Equals, "")
+	c.Assert(status.Backoff, check.Equals, "")
+	c.Assert(status.NextRetry, check.IsNil)
+	c.Assert(status.LastSuccess, check.NotNil)
+	c.Assert(status.LastReconcile, check.DeepEquals, status.LastSuccess)
+}
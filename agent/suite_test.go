@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -13,6 +14,7 @@ import (
 type S struct {
 	executor *fakeExecutor
 	tempfile string
+	tempdir  string
 }
 
 var _ = check.Suite(&S{})
@@ -22,16 +24,22 @@ func Test(t *testing.T) { check.TestingT(t) }
 func (s *S) SetUpTest(c *check.C) {
 	s.executor = &fakeExecutor{}
 	pkgExecutor = s.executor
-	f, err := ioutil.TempFile("", "iproute")
+	newExecutor = func(string, []string) (Executor, error) {
+		return s.executor, nil
+	}
+	f, err := ioutil.TempFile("", "agent")
 	c.Assert(err, check.IsNil)
 	s.tempfile = f.Name()
-	ipRouteFile = s.tempfile
 	err = f.Close()
 	c.Assert(err, check.IsNil)
+	s.tempdir, err = ioutil.TempDir("", "iproute2")
+	c.Assert(err, check.IsNil)
+	rtTablesDirs = []string{s.tempdir}
 }
 
 func (s *S) TearDownTest(c *check.C) {
 	os.Remove(s.tempfile)
+	os.RemoveAll(s.tempdir)
 }
 
 type fakeExecutor struct {
@@ -44,7 +52,7 @@ type fakeResult struct {
 	err  error
 }
 
-func (e *fakeExecutor) Exec(cmd string, args ...string) ([]byte, error) {
+func (e *fakeExecutor) Exec(ctx context.Context, cmd string, args ...string) ([]byte, error) {
 	e.log = append(e.log, append([]string{cmd}, args...))
 	key := fmt.Sprintf("%s %s", cmd, strings.Join(args, " "))
 	if e.results != nil {
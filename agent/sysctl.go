@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Sysctl modes supported by NATApplier.
+const (
+	SysctlIgnore = "ignore"
+	SysctlCheck  = "check"
+	SysctlSet    = "set"
+)
+
+// ProblemReporter may be implemented by appliers detecting misconfiguration
+// of the host which doesn't prevent applying, but may break routing.
+type ProblemReporter interface {
+	// Problems describes what was found by the last Apply.
+	Problems() []string
+}
+
+// sysctlSetting is a kernel parameter required for replies to be routed
+// through fusis.
+type sysctlSetting struct {
+	key string
+	// valid returns whether the current value works, want is the value set
+	// otherwise.
+	valid func(value string) bool
+	want  string
+	why   string
+}
+
+func (s sysctlSetting) problem(value string) string {
+	return fmt.Sprintf("%s is %s, %s", s.key, value, s.why)
+}
+
+func sysctlEquals(want string) func(string) bool {
+	return func(value string) bool {
+		return value == want
+	}
+}
+
+// sysctlSettings returns the settings required for the given interfaces.
+// Reverse path filtering uses the highest value between all and the
+// interface, strict mode drops replies whose source isn't routed back
+// through the interface they arrived in.
+func sysctlSettings(devices []string) []sysctlSetting {
+	settings := []sysctlSetting{
+		{key: "net.ipv4.ip_forward", valid: sysctlEquals("1"), want: "1", why: "forwarding must be enabled"},
+		{key: "net.ipv4.conf.all.src_valid_mark", valid: sysctlEquals("1"), want: "1", why: "marks must be considered by reverse path filtering"},
+	}
+	notStrict := func(value string) bool {
+		return value != "1"
+	}
+	for _, dev := range append([]string{"all"}, devices...) {
+		// Dots in interface names, as in VLANs, are slashes in sysctl keys.
+		key := fmt.Sprintf("net.ipv4.conf.%s.rp_filter", strings.Replace(dev, ".", "/", -1))
+		settings = append(settings, sysctlSetting{key: key, valid: notStrict, want: "2", why: "reverse path filtering must not be strict"})
+	}
+	return settings
+}
+
+// checkSysctls checks the kernel parameters for the interfaces used by
+// backends and the router, setting the ones not valid in set mode. It
+// returns the problems found.
+func (a *NATApplier) checkSysctls(ctx context.Context, backends []Backend) ([]string, error) {
+	if a.opts.Sysctl == SysctlIgnore {
+		return nil, nil
+	}
+	devices, err := a.interfaces(ctx, backends)
+	if err != nil {
+		return nil, err
+	}
+	settings := sysctlSettings(devices)
+	keys := make([]string, len(settings))
+	for i, s := range settings {
+		keys[i] = s.key
+	}
+	values, err := readSysctls(ctx, a.executor(), keys)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, s := range settings {
+		value, ok := values[s.key]
+		if !ok || s.valid(value) {
+			continue
+		}
+		if a.opts.Sysctl != SysctlSet {
+			problems = append(problems, s.problem(value))
+			continue
+		}
+		_, err = a.executor().Exec(ctx, "sysctl", "-w", s.key+"="+s.want)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("changed %s from %s to %s", s.key, value, s.want)
+		a.mu.Lock()
+		if _, changed := a.originals[s.key]; !changed {
+			a.originals[s.key] = value
+		}
+		a.mu.Unlock()
+	}
+	return problems, nil
+}
+
+// restoreSysctls sets the kernel parameters changed by a previous
+// configuration back to their original values.
+func (a *NATApplier) restoreSysctls(ctx context.Context, originals map[string]string) []string {
+	var errors []string
+	keys := make([]string, 0, len(originals))
+	for key := range originals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		_, err := a.executor().Exec(ctx, "sysctl", "-w", key+"="+originals[key])
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error restoring %s: %s", key, err))
+		}
+	}
+	return errors
+}
+
+// readSysctls returns the values of the given keys, unknown keys such as
+// the ones of interfaces which no longer exist are ignored.
+func readSysctls(ctx context.Context, exec Executor, keys []string) (map[string]string, error) {
+	out, err := exec.Exec(ctx, "sysctl", append([]string{"-e"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		values[key] = strings.TrimSpace(parts[1])
+	}
+	// Depending on the version slashes in keys are shown as dots.
+	for _, key := range keys {
+		if _, ok := values[key]; !ok {
+			if value, ok := values[strings.Replace(key, "/", ".", -1)]; ok {
+				values[key] = value
+			}
+		}
+	}
+	return values, nil
+}
+
+// interfaces returns the interfaces whose networks include backends or the
+// router, and the tunnel interface, sorted.
+func (a *NATApplier) interfaces(ctx context.Context, backends []Backend) ([]string, error) {
+	out, err := a.executor().Exec(ctx, "ip", "-o", "-4", "addr", "show")
+	if err != nil {
+		return nil, err
+	}
+	nets, err := parseAddrs(out)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	if a.opts.Tunnel != "" {
+		found[a.opts.TunnelName] = true
+	}
+	ips := []string{a.opts.Router}
+	if a.opts.Tunnel != "" {
+		ips = nil
+	}
+	for _, b := range backends {
+		ips = append(ips, b.IP)
+	}
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		for _, n := range nets {
+			if ip != nil && n.ipNet.Contains(ip) {
+				found[n.dev] = true
+			}
+		}
+	}
+	devices := make([]string, 0, len(found))
+	for dev := range found {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+	return devices, nil
+}
+
+type devNet struct {
+	dev   string
+	ipNet *net.IPNet
+}
+
+// parseAddrs parses the output of ip -o -4 addr show, with lines such as
+// "3: docker0    inet 172.17.0.1/16 brd 172.17.255.255 scope global docker0".
+func parseAddrs(out []byte) ([]devNet, error) {
+	var nets []devNet
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "inet" {
+			continue
+		}
+		// Interfaces in other namespaces are shown as name@peer.
+		dev := strings.SplitN(fields[1], "@", 2)[0]
+		_, ipNet, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid address in ip addr output: %s", err)
+		}
+		nets = append(nets, devNet{dev: dev, ipNet: ipNet})
+	}
+	return nets, nil
+}
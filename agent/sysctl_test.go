@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+
+	"gopkg.in/check.v1"
+)
+
+const testAddrs = `1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+2: eth0    inet 192.168.1.10/24 brd 192.168.1.255 scope global eth0\       valid_lft forever preferred_lft forever
+3: docker0    inet 172.17.0.1/16 brd 172.17.255.255 scope global docker0\       valid_lft forever preferred_lft forever
+4: eth0.100@eth0    inet 10.0.0.254/24 brd 10.0.0.255 scope global eth0.100\       valid_lft forever preferred_lft forever
+`
+
+const testSysctlRead = "sysctl -e net.ipv4.ip_forward net.ipv4.conf.all.src_valid_mark net.ipv4.conf.all.rp_filter " +
+	"net.ipv4.conf.docker0.rp_filter net.ipv4.conf.eth0.rp_filter net.ipv4.conf.eth0/100.rp_filter"
+
+func sysctlCommands(log [][]string) [][]string {
+	var cmds [][]string
+	for _, cmd := range log {
+		if cmd[0] == "sysctl" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+func (s *S) TestNewNATApplierSysctl(c *check.C) {
+	_, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Sysctl: "fix"})
+	c.Assert(err, check.ErrorMatches, `unknown sysctl mode "fix"`)
+}
+
+func (s *S) TestInterfaces(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1"})
+	c.Assert(err, check.IsNil)
+	s.executor.results = map[string]fakeResult{
+		"ip -o -4 addr show": {data: []byte(testAddrs)},
+	}
+	devices, err := nat.interfaces(context.Background(), testBackends("172.17.0.2", "10.0.0.1", "10.1.0.1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(devices, check.DeepEquals, []string{"docker0", "eth0", "eth0.100"})
+	nat, err = NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: TunnelIPIP})
+	c.Assert(err, check.IsNil)
+	devices, err = nat.interfaces(context.Background(), testBackends("172.17.0.2"))
+	c.Assert(err, check.IsNil)
+	c.Assert(devices, check.DeepEquals, []string{"docker0", "fusis0"})
+}
+
+func (s *S) TestApplySysctlCheck(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Sysctl: SysctlCheck})
+	c.Assert(err, check.IsNil)
+	s.executor.results = map[string]fakeResult{
+		"ip -o -4 addr show": {data: []byte(testAddrs)},
+		testSysctlRead: {data: []byte(`net.ipv4.ip_forward = 1
+net.ipv4.conf.all.src_valid_mark = 0
+net.ipv4.conf.all.rp_filter = 0
+net.ipv4.conf.docker0.rp_filter = 2
+net.ipv4.conf.eth0.rp_filter = 1
+net.ipv4.conf.eth0.100.rp_filter = 1
+`)},
+	}
+	a := Agent{
+		FusisAddress: "192.168.1.1",
+		applier:      nat,
+		source: &fakeSource{workloads: []Workload{
+			{ID: "c1", IPs: []string{"172.17.0.2"}},
+			{ID: "c2", IPs: []string{"10.0.0.1"}},
+		}},
+	}
+	err = a.reconcile(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(sysctlCommands(s.executor.log), check.HasLen, 1)
+	problems := []string{
+		"net.ipv4.conf.all.src_valid_mark is 0, marks must be considered by reverse path filtering",
+		"net.ipv4.conf.eth0.rp_filter is 1, reverse path filtering must not be strict",
+		"net.ipv4.conf.eth0/100.rp_filter is 1, reverse path filtering must not be strict",
+	}
+	c.Assert(nat.Problems(), check.DeepEquals, problems)
+	c.Assert(a.Status().Problems, check.DeepEquals, problems)
+	c.Assert(a.state.Sysctls, check.IsNil)
+}
+
+func (s *S) TestApplySysctlSet(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Sysctl: SysctlSet})
+	c.Assert(err, check.IsNil)
+	s.executor.results = map[string]fakeResult{
+		"ip -o -4 addr show": {data: []byte(testAddrs)},
+		"sysctl -e net.ipv4.ip_forward net.ipv4.conf.all.src_valid_mark net.ipv4.conf.all.rp_filter net.ipv4.conf.eth0.rp_filter": {data: []byte(`net.ipv4.ip_forward = 0
+net.ipv4.conf.all.src_valid_mark = 1
+net.ipv4.conf.all.rp_filter = 1
+net.ipv4.conf.eth0.rp_filter = 0
+`)},
+	}
+	err = nat.Apply(context.Background(), nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(sysctlCommands(s.executor.log)[1:], check.DeepEquals, [][]string{
+		{"sysctl", "-w", "net.ipv4.ip_forward=1"},
+		{"sysctl", "-w", "net.ipv4.conf.all.rp_filter=2"},
+	})
+	c.Assert(nat.Problems(), check.IsNil)
+	var state State
+	nat.describe(&state)
+	c.Assert(state.Sysctls, check.DeepEquals, map[string]string{
+		"net.ipv4.ip_forward":         "0",
+		"net.ipv4.conf.all.rp_filter": "1",
+	})
+	// Originals of a previous run are kept while still set.
+	other, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Sysctl: SysctlSet})
+	c.Assert(err, check.IsNil)
+	s.executor.log = nil
+	err = other.Cleanup(context.Background(), &state)
+	c.Assert(err, check.IsNil)
+	c.Assert(sysctlCommands(s.executor.log), check.IsNil)
+	var otherState State
+	other.describe(&otherState)
+	c.Assert(otherState.Sysctls, check.DeepEquals, state.Sysctls)
+	c.Assert(otherState.sameAs(&state), check.Equals, true)
+}
+
+func (s *S) TestCleanupSysctl(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "192.168.1.1", Sysctl: SysctlCheck})
+	c.Assert(err, check.IsNil)
+	err = nat.Cleanup(context.Background(), &State{
+		Router: "192.168.1.1",
+		Sysctls: map[string]string{
+			"net.ipv4.ip_forward":         "0",
+			"net.ipv4.conf.all.rp_filter": "1",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(sysctlCommands(s.executor.log), check.DeepEquals, [][]string{
+		{"sysctl", "-w", "net.ipv4.conf.all.rp_filter=1"},
+		{"sysctl", "-w", "net.ipv4.ip_forward=0"},
+	})
+	var state State
+	nat.describe(&state)
+	c.Assert(state.Sysctls, check.IsNil)
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Tunnel modes supported by NATApplier.
+const (
+	TunnelIPIP = "ipip"
+	TunnelGRE  = "gre"
+)
+
+// DefaultTunnelName is the tunnel interface used when none is given.
+const DefaultTunnelName = "fusis0"
+
+// tunnelOverhead is the encapsulation overhead of each tunnel mode, the
+// default MTU is the one of an ethernet link minus the overhead.
+var tunnelOverhead = map[string]int{
+	TunnelIPIP: 20,
+	TunnelGRE:  24,
+}
+
+const ethernetMTU = 1500
+
+func setTunnelDefaults(opts *NATOptions) error {
+	if opts.Tunnel == "" {
+		// Tunnel options are meaningless without a tunnel.
+		opts.TunnelName, opts.TunnelLocal, opts.TunnelMTU = "", "", 0
+		return nil
+	}
+	overhead, ok := tunnelOverhead[opts.Tunnel]
+	if !ok {
+		return fmt.Errorf("unknown tunnel mode %q", opts.Tunnel)
+	}
+	if opts.TunnelName == "" {
+		opts.TunnelName = DefaultTunnelName
+	}
+	if opts.TunnelLocal != "" {
+		if ip := net.ParseIP(opts.TunnelLocal); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid tunnel local address %q", opts.TunnelLocal)
+		}
+	}
+	if opts.TunnelMTU == 0 {
+		opts.TunnelMTU = ethernetMTU - overhead
+	}
+	if opts.TunnelMTU < 576 {
+		return fmt.Errorf("invalid tunnel MTU %d", opts.TunnelMTU)
+	}
+	return nil
+}
+
+// createTunnel ensures the tunnel to the router exists with the configured
+// mode and addresses, recreating it otherwise, and is up with the configured
+// MTU.
+func (a *NATApplier) createTunnel(ctx context.Context) error {
+	tunnel := ipTunnel{executor: a.executor()}
+	wanted := tunnelConfig{
+		Name:   a.opts.TunnelName,
+		Mode:   a.opts.Tunnel,
+		Remote: a.opts.Router,
+		Local:  a.opts.TunnelLocal,
+	}
+	current, err := tunnel.Show(ctx, wanted.Name)
+	if err != nil {
+		return err
+	}
+	if current != nil && *current != wanted {
+		log.Printf("recreating tunnel %s, was %s", wanted, current)
+		err = tunnel.Del(ctx, wanted.Name)
+		if err != nil {
+			return err
+		}
+		current = nil
+	}
+	if current == nil {
+		err = tunnel.Add(ctx, wanted)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = a.executor().Exec(ctx, "ip", "link", "set", wanted.Name, "mtu", strconv.Itoa(a.opts.TunnelMTU), "up")
+	return err
+}
+
+// cleanupTunnel removes the tunnel and the MSS clamping chain left by a
+// previous configuration, described by old, if they're not used anymore.
+// Routes through the tunnel are removed with it.
+func (a *NATApplier) cleanupTunnel(ctx context.Context, old *State) []string {
+	var errors []string
+	if old.Tunnel == "" {
+		return nil
+	}
+	if old.Tunnel != a.opts.TunnelName {
+		tunnel := ipTunnel{executor: a.executor()}
+		err := tunnel.Del(ctx, old.Tunnel)
+		if err != nil && err != errNoSuchTunnel {
+			errors = append(errors, fmt.Sprintf("error removing tunnel %s: %s", old.Tunnel, err))
+		}
+	}
+	// A chain still used is kept, its rule is replaced by Apply if needed.
+	if old.Chain != "" && (a.opts.Tunnel == "" || old.Chain != a.opts.Chain) {
+		err := a.removeChain(ctx, mssChain(old.Chain), "POSTROUTING")
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error removing chain %s: %s", mssChain(old.Chain), err))
+		}
+	}
+	return errors
+}
+
+func mssChain(chain string) string {
+	return chain + "_MSS"
+}
+
+func (a *NATApplier) mssChain() string {
+	return mssChain(a.opts.Chain)
+}
+
+// mssClampRule returns the arguments of the rule clamping the MSS of TCP
+// connections through the tunnel to its path MTU, as shown by iptables-save.
+func (a *NATApplier) mssClampRule() []string {
+	return []string{"-o", a.opts.TunnelName, "-p", "tcp", "-m", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"}
+}
+
+// ensureMSSClamp ensures packets leaving through the tunnel go through a
+// chain with only the MSS clamping rule, so connections don't depend on
+// fragmentation or ICMP reaching the backends.
+func (a *NATApplier) ensureMSSClamp(ctx context.Context, table *ipTables, current *iptablesTable) error {
+	name := a.mssChain()
+	chain := current.Chain(name)
+	if chain == nil {
+		err := table.New(ctx, "-N", name)
+		if err != nil && err != errChainExists {
+			return err
+		}
+		chain = &iptablesChain{Name: name}
+	}
+	err := a.ensureJump(ctx, table, current, "POSTROUTING", name)
+	if err != nil {
+		return err
+	}
+	rule := a.mssClampRule()
+	if len(chain.Rules) == 1 && chain.Rules[0].Equal(rule...) {
+		return nil
+	}
+	if len(chain.Rules) > 0 {
+		log.Printf("replacing %d unexpected rules in chain %s", len(chain.Rules), name)
+		err = table.New(ctx, "-F", name)
+		if err != nil {
+			return err
+		}
+	}
+	return table.New(ctx, append([]string{"-A", name}, rule...)...)
+}
+
+// verifyMSSClamp returns a description of the differences between the MSS
+// clamping chain and the expected one.
+func (a *NATApplier) verifyMSSClamp(current *iptablesTable) []string {
+	name := a.mssChain()
+	chain := current.Chain(name)
+	if chain == nil {
+		return []string{fmt.Sprintf("chain %s missing", name)}
+	}
+	var drift []string
+	if jumps := countJumps(current.Chain("POSTROUTING"), name); jumps != 1 {
+		drift = append(drift, fmt.Sprintf("%d jumps to chain %s in POSTROUTING", jumps, name))
+	}
+	if len(chain.Rules) != 1 || !chain.Rules[0].Equal(a.mssClampRule()...) {
+		drift = append(drift, fmt.Sprintf("unexpected rules in chain %s", name))
+	}
+	return drift
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"errors"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestNewNATApplierTunnel(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: TunnelIPIP})
+	c.Assert(err, check.IsNil)
+	c.Assert(nat.Options().TunnelName, check.Equals, "fusis0")
+	c.Assert(nat.Options().TunnelMTU, check.Equals, 1480)
+	nat, err = NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: TunnelGRE, TunnelName: "gre1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(nat.Options().TunnelName, check.Equals, "gre1")
+	c.Assert(nat.Options().TunnelMTU, check.Equals, 1476)
+	nat, err = NewNATApplier(NATOptions{Router: "10.1.1.1", TunnelName: "gre1", TunnelMTU: 1400})
+	c.Assert(err, check.IsNil)
+	c.Assert(nat.Options().TunnelName, check.Equals, "")
+	c.Assert(nat.Options().TunnelMTU, check.Equals, 0)
+	_, err = NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: "vxlan"})
+	c.Assert(err, check.ErrorMatches, `unknown tunnel mode "vxlan"`)
+	_, err = NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: TunnelIPIP, TunnelLocal: "local"})
+	c.Assert(err, check.ErrorMatches, `invalid tunnel local address "local"`)
+	_, err = NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: TunnelIPIP, TunnelMTU: 100})
+	c.Assert(err, check.ErrorMatches, `invalid tunnel MTU 100`)
+}
+
+func (s *S) TestParseTunnel(c *check.C) {
+	t, err := parseTunnel("fusis0", []byte("fusis0: ip/ip remote 10.1.1.1 local any ttl 64\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(*t, check.Equals, tunnelConfig{Name: "fusis0", Mode: "ipip", Remote: "10.1.1.1"})
+	t, err = parseTunnel("fusis0", []byte("fusis0: gre/ip remote 10.1.1.1 local 10.0.0.2 ttl 64\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(*t, check.Equals, tunnelConfig{Name: "fusis0", Mode: "gre", Remote: "10.1.1.1", Local: "10.0.0.2"})
+	_, err = parseTunnel("fusis0", []byte("other: gre/ip remote 10.1.1.1\n"))
+	c.Assert(err, check.ErrorMatches, `unexpected ip tunnel output: .*`)
+}
+
+var tunnelExpected = [][]string{
+	{"ip", "tunnel", "add", "fusis0", "mode", "ipip", "remote", "10.1.1.1", "local", "10.0.0.2", "ttl", "64"},
+	{"ip", "link", "set", "fusis0", "mtu", "1480", "up"},
+	{"ip", "route", "replace", "default", "dev", "fusis0", "table", "100"},
+	{"ip", "rule", "list"},
+	{"ip", "rule", "add", "pref", "32765", "fwmark", "9", "table", "100"},
+	{"iptables-save", "-t", "mangle"},
+	{"iptables", "-t", "mangle", "-w", "5", "-N", "FUSIS"},
+	{"iptables", "-t", "mangle", "-w", "5", "-I", "PREROUTING", "-j", "FUSIS"},
+	{"iptables", "-t", "mangle", "-w", "5", "-N", "FUSIS_MSS"},
+	{"iptables", "-t", "mangle", "-w", "5", "-I", "POSTROUTING", "-j", "FUSIS_MSS"},
+	{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS_MSS", "-o", "fusis0", "-p", "tcp", "-m", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"},
+	{"iptables", "-t", "mangle", "-w", "5", "-A", "FUSIS", "-s", "10.0.0.1", "-j", "MARK", "--set-mark", "9"},
+}
+
+func (s *S) TestApplyTunnel(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: TunnelIPIP, TunnelLocal: "10.0.0.2"})
+	c.Assert(err, check.IsNil)
+	s.executor.results = map[string]fakeResult{
+		"ip tunnel show fusis0": {data: []byte("ip: ioctl 0x89f4 failed: No such device\n"), err: errors.New("exit 1")},
+	}
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, append([][]string{{"ip", "tunnel", "show", "fusis0"}}, tunnelExpected...))
+	s.executor.log = nil
+	s.executor.results = map[string]fakeResult{
+		"ip tunnel show fusis0": {data: []byte("fusis0: gre/ip remote 10.1.1.1 local any ttl 64\n")},
+	}
+	err = nat.Apply(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, append([][]string{
+		{"ip", "tunnel", "show", "fusis0"},
+		{"ip", "tunnel", "del", "fusis0"},
+	}, tunnelExpected...))
+}
+
+func (s *S) TestVerifyTunnel(c *check.C) {
+	nat, err := NewNATApplier(NATOptions{Router: "10.1.1.1", Tunnel: TunnelIPIP})
+	c.Assert(err, check.IsNil)
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:PREROUTING ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:FUSIS - [0:0]
+:FUSIS_MSS - [0:0]
+-A PREROUTING -j FUSIS
+-A FUSIS -s 10.0.0.1/32 -j MARK --set-xmark 0x9/0xffffffff
+-A FUSIS_MSS -o fusis1 -p tcp -m tcp --tcp-flags SYN,RST SYN -j TCPMSS --clamp-mss-to-pmtu
+COMMIT
+`)},
+	}
+	drift, err := nat.Verify(context.Background(), testBackends("10.0.0.1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(drift, check.DeepEquals, []string{
+		"0 jumps to chain FUSIS_MSS in POSTROUTING",
+		"unexpected rules in chain FUSIS_MSS",
+	})
+}
+
+func (s *S) TestCleanupTunnel(c *check.C) {
+	nat := newTestNAT(c)
+	s.executor.results = map[string]fakeResult{
+		"iptables-save -t mangle": {data: []byte(`*mangle
+:POSTROUTING ACCEPT [0:0]
+:FUSIS_MSS - [0:0]
+-A POSTROUTING -j FUSIS_MSS
+COMMIT
+`)},
+	}
+	err := nat.Cleanup(context.Background(), &State{
+		Router:    "10.1.1.1",
+		Mark:      "9",
+		TableID:   100,
+		TableName: "fusis.out",
+		Chain:     "FUSIS",
+		Tunnel:    "fusis0",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(s.executor.log, check.DeepEquals, [][]string{
+		{"ip", "tunnel", "del", "fusis0"},
+		{"iptables-save", "-t", "mangle"},
+		{"iptables", "-t", "mangle", "-w", "5", "-D", "POSTROUTING", "-j", "FUSIS_MSS"},
+		{"iptables", "-t", "mangle", "-w", "5", "-F", "FUSIS_MSS"},
+		{"iptables", "-t", "mangle", "-w", "5", "-X", "FUSIS_MSS"},
+	})
+}
@@ -5,7 +5,10 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
@@ -17,24 +20,196 @@ import (
 	"github.com/urfave/cli"
 )
 
+var stateFileFlag = cli.StringFlag{
+	Name:  "state-file",
+	Value: "/var/lib/fusis-agent/state.json",
+	Usage: "File where the applied state is persisted, used to clean up after configuration changes.\n" +
+		"If empty the state is not persisted",
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "runtime, r",
+			Value: agent.RuntimeDocker,
+			Usage: "Container runtime used to discover containers, either docker, swarm, containerd,\n" +
+				"kubernetes or none to only use the backends file",
+		},
+		cli.StringFlag{
+			Name:  "executor",
+			Value: agent.ExecutorAuto,
+			Usage: "How ip and iptables commands are run, either direct, requiring root or the CAP_NET_ADMIN\n" +
+				"and CAP_NET_RAW capabilities, sudo or auto to run directly if possible",
+		},
+		cli.StringFlag{
+			Name:  "netns",
+			Value: "",
+			Usage: "Path of the network namespace where rules and routes are applied, such as /proc/1/ns/net,\n" +
+				"allowing the agent to run without --net=host. If empty the agent namespace is used",
+		},
+		cli.StringFlag{
+			Name:  "tunnel",
+			Value: "",
+			Usage: "Route through an ipip or gre tunnel to the fusis router, when it's not reachable on-link.\n" +
+				"If empty the router is used as gateway",
+		},
+		cli.StringFlag{
+			Name:  "tunnel-name",
+			Value: agent.DefaultTunnelName,
+			Usage: "Name of the tunnel interface",
+		},
+		cli.StringFlag{
+			Name:  "tunnel-local",
+			Value: "",
+			Usage: "Local address of the tunnel, if empty it's chosen by the kernel",
+		},
+		cli.IntFlag{
+			Name:  "tunnel-mtu",
+			Value: 0,
+			Usage: "MTU of the tunnel interface, if zero 1500 minus the encapsulation overhead is used",
+		},
+		cli.IntFlag{
+			Name:  "rule-priority",
+			Value: agent.DefaultRulePriority,
+			Usage: "Priority of the ip rule routing marked packets through the fusis router, rules taking\n" +
+				"precedence over it are reported in the status",
+		},
+		cli.BoolFlag{
+			Name: "table-drop-in",
+			Usage: "Name the routing table fusis.out in /etc/iproute2/rt_tables.d/fusis.out.conf, otherwise it's\n" +
+				"only known by its number, 100",
+		},
+		cli.BoolFlag{
+			Name: "flush-conntrack",
+			Usage: "Delete conntrack entries of addresses no longer used by backends, so their established\n" +
+				"connections don't affect a new container reusing them. Requires CAP_NET_ADMIN",
+		},
+		cli.BoolFlag{
+			Name: "aggregate-rules",
+			Usage: "Mark contiguous backend addresses with a rule for each prefix covering exactly them, instead\n" +
+				"of a rule for each address",
+		},
+		cli.BoolFlag{
+			Name:  "healthy-only",
+			Usage: "Only mark containers whose docker healthcheck reports them healthy",
+		},
+		cli.StringFlag{
+			Name:  "without-healthcheck",
+			Value: agent.HealthcheckInclude,
+			Usage: "Whether containers without healthcheck are included or excluded when only healthy ones\n" +
+				"are marked",
+		},
+		cli.BoolFlag{
+			Name: "cgroup-match",
+			Usage: "Mark packets of docker containers using the host network by their cgroup v2 path instead of\n" +
+				"their ports. Requires sharing the host PID namespace. Containers in other networks are still\n" +
+				"marked by address, their packets aren't sent from host sockets which cgroups could match",
+		},
+		cli.StringFlag{
+			Name:  "sysctl",
+			Value: agent.SysctlCheck,
+			Usage: "Whether rp_filter, ip_forward and src_valid_mark kernel parameters of the interfaces used are\n" +
+				"checked, reporting misconfiguration in the status, set, restoring them once not set anymore,\n" +
+				"or ignored",
+		},
 		cli.StringFlag{
 			Name:  "docker, d",
-			Value: "unix:///var/run/docker.sock",
-			Usage: "Docker address",
+			Value: "",
+			Usage: "Docker address, if empty DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH\n" +
+				"environment variables are used, defaulting to unix:///var/run/docker.sock",
+		},
+		cli.StringFlag{
+			Name:  "docker-tls-cert",
+			Value: "",
+			Usage: "Path to the TLS client certificate used to connect to docker, given along with the key and CA",
 		},
+		cli.StringFlag{
+			Name:  "docker-tls-key",
+			Value: "",
+			Usage: "Path to the TLS client key used to connect to docker",
+		},
+		cli.StringFlag{
+			Name:  "docker-tls-ca",
+			Value: "",
+			Usage: "Path to the CA certificate used to verify the docker daemon",
+		},
+		cli.StringFlag{
+			Name:  "docker-api-version",
+			Value: "",
+			Usage: "Docker remote API version to use, if empty the daemon version is used",
+		},
+		cli.StringFlag{
+			Name:  "swarm-network",
+			Value: "",
+			Usage: "Network, usually an overlay, whose address is used for swarm service tasks when using\n" +
+				"the swarm runtime. Labels are matched against services, or task containers on worker nodes\n" +
+				"where services can't be listed",
+		},
+		cli.StringFlag{
+			Name:  "containerd-address",
+			Value: "/run/containerd/containerd.sock",
+			Usage: "Containerd socket address",
+		},
+		cli.StringFlag{
+			Name:  "containerd-namespace",
+			Value: "default",
+			Usage: "Containerd namespace where containers are looked up",
+		},
+		cli.DurationFlag{
+			Name:  "containerd-poll-interval",
+			Value: agent.DefaultContainerdPollInterval,
+			Usage: "Interval between task listings used to watch containerd for changes",
+		},
+		cli.StringFlag{
+			Name:  "kubernetes-api",
+			Value: "",
+			Usage: "Kubernetes API server address, if empty the in-cluster configuration is used",
+		},
+		cli.StringFlag{
+			Name:  "kubernetes-token-file",
+			Value: "",
+			Usage: "File containing the bearer token used to authenticate with kubernetes",
+		},
+		cli.StringFlag{
+			Name:  "kubernetes-ca-file",
+			Value: "",
+			Usage: "CA certificate used to verify the kubernetes API server",
+		},
+		cli.StringFlag{
+			Name:   "node-name",
+			Value:  "",
+			EnvVar: "NODE_NAME",
+			Usage:  "Name of the kubernetes node where the agent is running",
+		},
+		cli.StringFlag{
+			Name:  "backends-file",
+			Value: "",
+			Usage: "File with additional backend IPs, one per line or a JSON list, watched for changes",
+		},
+		stateFileFlag,
 		cli.StringFlag{
 			Name:  "label-filter, f",
 			Value: "router=fusis",
-			Usage: "Label to lookup when listing docker containers",
+			Usage: "Label to lookup when listing containers, a label selector for kubernetes pods",
 		},
 		cli.DurationFlag{
 			Name:  "interval, i",
 			Value: time.Minute,
-			Usage: "Interval between calls docker listing containers.\n" +
-				"Docker events will also be used, pooling interval is a failsafe mechanism for missed events",
+			Usage: "Interval between calls listing containers.\n" +
+				"Runtime events will also be used, pooling interval is a failsafe mechanism for missed events",
+		},
+		cli.DurationFlag{
+			Name:  "verify-interval",
+			Value: 10 * time.Second,
+			Usage: "Interval between checks of the applied iptables rules, triggering a reconcile if they were\n" +
+				"changed by someone else. Zero disables the check",
+		},
+		cli.StringFlag{
+			Name:  "metrics-addr",
+			Value: "",
+			Usage: "Address to serve metrics on, in /debug/vars, and the agent status, in /status. If empty\n" +
+				"neither is served",
 		},
 		cli.StringFlag{
 			Name:  "fusis-addr, a",
@@ -45,6 +220,14 @@ func main() {
 	app.Version = "0.1.0"
 	app.Name = "fusis-agent"
 	app.Action = runAgent
+	app.Commands = []cli.Command{
+		{
+			Name:   "state",
+			Usage:  "Show the state last applied by the agent",
+			Flags:  []cli.Flag{stateFileFlag},
+			Action: showState,
+		},
+	}
 	app.Author = "fusis team"
 	app.Email = "https://github.com/luizbafilho/fusis"
 	app.Run(os.Args)
@@ -52,10 +235,40 @@ func main() {
 
 func runAgent(c *cli.Context) error {
 	a := agent.Agent{
-		DockerAddress: c.String("docker"),
-		FusisAddress:  c.String("fusis-addr"),
-		LabelFilter:   c.String("label-filter"),
-		Interval:      c.Duration("interval"),
+		Runtime:                c.String("runtime"),
+		Executor:               c.String("executor"),
+		DockerAddress:          c.String("docker"),
+		DockerTLSCert:          c.String("docker-tls-cert"),
+		DockerTLSKey:           c.String("docker-tls-key"),
+		DockerTLSCA:            c.String("docker-tls-ca"),
+		DockerAPIVersion:       c.String("docker-api-version"),
+		SwarmNetwork:           c.String("swarm-network"),
+		ContainerdAddress:      c.String("containerd-address"),
+		ContainerdNamespace:    c.String("containerd-namespace"),
+		ContainerdPollInterval: c.Duration("containerd-poll-interval"),
+		KubernetesAPI:          c.String("kubernetes-api"),
+		KubernetesTokenFile:    c.String("kubernetes-token-file"),
+		KubernetesCAFile:       c.String("kubernetes-ca-file"),
+		NodeName:               c.String("node-name"),
+		NetNamespace:           c.String("netns"),
+		Tunnel:                 c.String("tunnel"),
+		TunnelName:             c.String("tunnel-name"),
+		TunnelLocal:            c.String("tunnel-local"),
+		TunnelMTU:              c.Int("tunnel-mtu"),
+		Sysctl:                 c.String("sysctl"),
+		RulePriority:           c.Int("rule-priority"),
+		TableDropIn:            c.Bool("table-drop-in"),
+		FlushConntrack:         c.Bool("flush-conntrack"),
+		AggregateRules:         c.Bool("aggregate-rules"),
+		CgroupMatch:            c.Bool("cgroup-match"),
+		HealthyOnly:            c.Bool("healthy-only"),
+		WithoutHealthcheck:     c.String("without-healthcheck"),
+		BackendsFile:           c.String("backends-file"),
+		StateFile:              c.String("state-file"),
+		FusisAddress:           c.String("fusis-addr"),
+		LabelFilter:            c.String("label-filter"),
+		Interval:               c.Duration("interval"),
+		VerifyInterval:         c.Duration("verify-interval"),
 	}
 	if a.FusisAddress == "" {
 		return cli.NewExitError("Parameter --fusis-addr is mandatory", 1)
@@ -64,10 +277,39 @@ func runAgent(c *cli.Context) error {
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
+	if addr := c.String("metrics-addr"); addr != "" {
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(a.Status())
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, nil))
+		}()
+	}
 	handleSignals(&a)
 	log.Print("Running agent...")
 	a.Start()
-	a.Wait()
+	err = a.Wait()
+	if err != nil && err != agent.ErrStopped {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func showState(c *cli.Context) error {
+	path := c.String("state-file")
+	if c.GlobalIsSet("state-file") {
+		path = c.GlobalString("state-file")
+	}
+	state, err := agent.ReadState(path)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to read state: %s", err), 1)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println(string(data))
 	return nil
 }
 